@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// cidrList is a list of networks given as CIDR ranges or single addresses, separated by commas.
+type cidrList []*net.IPNet
+
+func (l *cidrList) String() string {
+	networks := make([]string, len(*l))
+	for i, network := range *l {
+		networks[i] = network.String()
+	}
+	return strings.Join(networks, ",")
+}
+
+func (l *cidrList) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			*l = append(*l, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR range %q", entry)
+		}
+		*l = append(*l, network)
+	}
+	return nil
+}
+
+func (l cidrList) Contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// repoList is a list of repository names separated by commas.
+type repoList []string
+
+func (l *repoList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *repoList) Set(value string) error {
+	for _, repo := range strings.Split(value, ",") {
+		repo = strings.TrimSpace(repo)
+		if len(repo) == 0 {
+			continue
+		}
+		if !validPathComponent(repo) {
+			return fmt.Errorf("invalid repository %q", repo)
+		}
+		*l = append(*l, repo)
+	}
+	return nil
+}
+
+// allows reports whether repo may be proxied, which all are if the list is empty.
+func (l repoList) allows(repo string) bool {
+	if len(l) == 0 {
+		return true
+	}
+	for _, allowed := range l {
+		if repo == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client, taken from X-Forwarded-For if the request was
+// passed on by one of the trusted proxies.
+func clientIP(r *http.Request, trustedProxies cidrList) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxies.Contains(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trustedProxies.Contains(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientName returns the address of the client as accounted in the stats, "unknown" if it has none, e.g. when
+// connected through a unix socket.
+func clientName(r *http.Request) string {
+	if ip := clientIP(r, GetSettings().TrustedProxies); ip != nil {
+		return ip.String()
+	}
+	return "unknown"
+}
+
+// clientAllowed decides whether ip may use the proxy. Allowed ranges take precedence over denied ones,
+// once any range is allowed all other clients are denied.
+func clientAllowed(ip net.IP, allow cidrList, deny cidrList) bool {
+	if ip == nil {
+		return len(allow) == 0 && len(deny) == 0
+	}
+	if allow.Contains(ip) {
+		return true
+	}
+	return len(allow) == 0 && !deny.Contains(ip)
+}
+
+// withAccessControl answers requests of clients which are not allowed to use the proxy with 403.
+func withAccessControl(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := GetSettings()
+		if len(s.Allow) > 0 || len(s.Deny) > 0 {
+			if ip := clientIP(r, s.TrustedProxies); !clientAllowed(ip, s.Allow, s.Deny) {
+				warnf("", "Incoming", "Client %s is not allowed, sending %q", ip, http.StatusText(http.StatusForbidden))
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
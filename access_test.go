@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func mustCIDRList(t *testing.T, value string) cidrList {
+	var l cidrList
+	if err := l.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestCIDRListSet(t *testing.T) {
+	l := mustCIDRList(t, "10.0.0.0/8, 192.168.1.5,::1")
+	if l.String() != "10.0.0.0/8,192.168.1.5/32,::1/128" {
+		t.Errorf("Unexpected ranges %s", l.String())
+	}
+	if err := l.Set("10.0.0.0/33"); err == nil {
+		t.Error("Invalid range should be rejected")
+	}
+	if err := l.Set("example.org"); err == nil {
+		t.Error("Host name should be rejected")
+	}
+}
+
+func TestClientAllowed(t *testing.T) {
+	allow := mustCIDRList(t, "10.1.0.0/16")
+	deny := mustCIDRList(t, "10.0.0.0/8")
+	for _, tc := range []struct {
+		ip      string
+		allow   cidrList
+		deny    cidrList
+		allowed bool
+	}{
+		{"192.0.2.1", nil, nil, true},
+		{"192.0.2.1", nil, deny, true},
+		{"10.2.0.1", nil, deny, false},
+		{"10.1.0.1", allow, deny, true},
+		{"10.2.0.1", allow, deny, false},
+		{"192.0.2.1", allow, nil, false},
+	} {
+		if clientAllowed(net.ParseIP(tc.ip), tc.allow, tc.deny) != tc.allowed {
+			t.Errorf("Client %s with allow %v and deny %v: expected allowed = %t", tc.ip, tc.allow.String(), tc.deny.String(), tc.allowed)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := mustCIDRList(t, "127.0.0.1")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.2")
+	if ip := clientIP(r, nil); !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("X-Forwarded-For should be ignored without trusted proxies, got %s", ip)
+	}
+	if ip := clientIP(r, trusted); !ip.Equal(net.ParseIP("198.51.100.2")) {
+		t.Errorf("Expected the last untrusted hop, got %s", ip)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	if ip := clientIP(r, trusted); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("X-Forwarded-For of an untrusted client should be ignored, got %s", ip)
+	}
+}
+
+func TestWithAccessControl(t *testing.T) {
+	defer SetSettings(GetSettings())
+	SetSettings(&Settings{Deny: mustCIDRList(t, "192.0.2.0/24")})
+	h := withAccessControl(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Denied client got %d, expected 403", rec.Code)
+	}
+
+	r.RemoteAddr = "198.51.100.1:1234"
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Allowed client got %d, expected 200", rec.Code)
+	}
+}
+
+func TestHandlerRepos(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	var repos repoList
+	if err := repos.Set("core, extra"); err != nil {
+		t.Fatal(err)
+	}
+	updateSettings(func(s *Settings) { s.Repos = repos })
+
+	for repo, code := range map[string]int{"core": http.StatusOK, "extra": http.StatusOK, "evil": http.StatusForbidden} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/"+repo+"/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+		if rec.Code != code {
+			t.Errorf("Request for %s got %d, expected %d", repo, rec.Code, code)
+		}
+	}
+	if err := repos.Set("../etc"); err == nil {
+		t.Error("Invalid repository was accepted")
+	}
+}
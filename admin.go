@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// adminAuthorized checks the bearer token of requests to the admin endpoints, which are disabled without one.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token := GetSettings().AdminToken
+	if len(token) == 0 {
+		http.NotFound(w, r)
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+		warnf("", "Admin", "Unauthorized request for %s from %s", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	changed, err := reloadSettings()
+	if err != nil {
+		errorf("", "Admin", "Reload failed: %s", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	logf("", "Admin", "Reloaded settings, changed: %v", changed)
+	if changed == nil {
+		changed = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Changed []string `json:"changed"`
+	}{changed})
+}
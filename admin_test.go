@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestDiffSettings(t *testing.T) {
+	current := &Settings{CacheDir: "/a", UpstreamServers: []string{"one"}, DebugHeaders: true}
+	fresh := &Settings{CacheDir: "/b", UpstreamServers: []string{"one", "two"}, DebugHeaders: true, ShowVersion: true}
+	changed, restart := diffSettings(current, fresh)
+	if !reflect.DeepEqual(changed, []string{"upstream"}) {
+		t.Errorf("Changed settings = %v, expected [upstream]", changed)
+	}
+	if !reflect.DeepEqual(restart, []string{"cache"}) {
+		t.Errorf("Settings requiring a restart = %v, expected [cache]", restart)
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	setupTestCache(t)
+	for _, tc := range []struct {
+		token  string
+		auth   string
+		method string
+		status int
+	}{
+		{"", "Bearer secret", http.MethodPost, http.StatusNotFound},
+		{"secret", "", http.MethodPost, http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.MethodPost, http.StatusUnauthorized},
+		{"secret", "Basic secret", http.MethodPost, http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.MethodGet, http.StatusMethodNotAllowed},
+	} {
+		updateSettings(func(s *Settings) { s.AdminToken = tc.token })
+		r := httptest.NewRequest(tc.method, "/admin/reload", nil)
+		if len(tc.auth) > 0 {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		adminReloadHandler(w, r)
+		if w.Code != tc.status {
+			t.Errorf("Token %q, Authorization %q, %s: status %d, expected %d", tc.token, tc.auth, tc.method, w.Code, tc.status)
+		}
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	configFile := path.Join(cacheDir, "pkgproxy.toml")
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("admin-token = \"secret\"\n")
+
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"pkgproxy", "-cache", cacheDir, "-config", configFile}
+	s, err := parseSettings(flag.NewFlagSet("pkgproxy", flag.ContinueOnError), os.Args[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Mirrors = newMirrors(s.UpstreamServers)
+	SetSettings(s)
+	mirror := s.Mirrors[0]
+
+	reload := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		adminReloadHandler(w, r)
+		return w
+	}
+
+	writeConfig("admin-token = \"secret\"\ndebug-headers = true\n")
+	w := reload()
+	var result struct {
+		Changed []string `json:"changed"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || !reflect.DeepEqual(result.Changed, []string{"debug-headers"}) {
+		t.Errorf("Reload returned %d with %v, expected 200 with [debug-headers]", w.Code, result.Changed)
+	}
+	if !GetSettings().DebugHeaders {
+		t.Error("Reloaded setting was not applied")
+	}
+	if GetSettings().Mirrors[0] != mirror {
+		t.Error("Unchanged mirror was not kept across reload")
+	}
+
+	writeConfig("admin-token = \"secret\"\ndebug-headers = true\nkeep-cache = true\n")
+	if w := reload(); w.Code != http.StatusConflict {
+		t.Errorf("Reload changing keep-cache returned %d, expected 409", w.Code)
+	}
+	if GetSettings().KeepCache {
+		t.Error("Setting requiring a restart was applied")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveEntry locates a regular file inside a tar archive.
+type archiveEntry struct {
+	offset  int64
+	size    int64
+	modTime time.Time
+}
+
+// archiveIndex maps the names of all regular files inside a tar archive to their location.
+type archiveIndex struct {
+	modTime time.Time
+	entries map[string]archiveEntry
+}
+
+var archiveIndexes = make(map[string]*archiveIndex)
+var archiveIndexesMutex sync.Mutex
+
+// archiveTransport serves upstream requests for archive:// URLs from a local tar archive,
+// e.g. archive:///srv/archlinux-snapshot.tar/$repo/os/$arch.
+type archiveTransport struct{}
+
+// splitArchivePath splits an archive URL path into the path of the archive and the name of the entry.
+func splitArchivePath(urlPath string) (string, string, bool) {
+	i := strings.Index(urlPath, ".tar/")
+	if i < 0 {
+		return "", "", false
+	}
+	return urlPath[:i+4], urlPath[i+5:], true
+}
+
+// buildArchiveIndex reads all headers of the tar archive at archivePath.
+func buildArchiveIndex(archivePath string) (*archiveIndex, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	index := &archiveIndex{modTime: fi.ModTime(), entries: make(map[string]archiveEntry)}
+
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return index, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		index.entries[name] = archiveEntry{offset: offset, size: hdr.Size, modTime: hdr.ModTime}
+	}
+}
+
+// getArchiveIndex returns the index of the tar archive at archivePath, rebuilding it when the archive changed.
+func getArchiveIndex(archivePath string) (*archiveIndex, error) {
+	archiveIndexesMutex.Lock()
+	defer archiveIndexesMutex.Unlock()
+
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	index, ok := archiveIndexes[archivePath]
+	if !ok || !index.modTime.Equal(fi.ModTime()) {
+		index, err = buildArchiveIndex(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		archiveIndexes[archivePath] = index
+	}
+	return index, nil
+}
+
+func newArchiveResponse(req *http.Request, code int) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+}
+
+func (archiveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	archivePath, name, ok := splitArchivePath(req.URL.Path)
+	if !ok {
+		return newArchiveResponse(req, http.StatusBadRequest), nil
+	}
+	index, err := getArchiveIndex(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := index.entries[name]
+	if !ok {
+		return newArchiveResponse(req, http.StatusNotFound), nil
+	}
+
+	resp := newArchiveResponse(req, http.StatusOK)
+	resp.ContentLength = entry.size
+	resp.Header.Set("Content-Length", strconv.FormatInt(entry.size, 10))
+	resp.Header.Set("Last-Modified", entry.modTime.UTC().Format(http.TimeFormat))
+	if req.Method == http.MethodHead {
+		return resp, nil
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, entry.offset, entry.size), file}
+	return resp, nil
+}
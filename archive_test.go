@@ -0,0 +1,56 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestArchiveUpstream(t *testing.T) {
+	archiveDir, err := ioutil.TempDir("", "pkgproxy-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archiveDir)
+	archivePath := path.Join(archiveDir, "snapshot.tar")
+
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(file)
+	for name, content := range map[string]string{
+		"./extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz": testPackage,
+		"./extra/os/x86_64/extra.db":                    "database",
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	file.Close()
+
+	defer os.RemoveAll(setupTestCache(t, "archive://"+archivePath))
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+		t.Error("Package was not served from the archive")
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/extra.db", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "database" {
+		t.Error("Database was not served from the archive")
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/bar-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Error("Missing archive entry should result in 404")
+	}
+}
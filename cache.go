@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileLock serialises all work on a single cache file. It is held while its channel holds a value.
+type fileLock struct {
+	held     chan struct{}
+	refCount int
+}
+
+func newFileLock() *fileLock {
+	return &fileLock{held: make(chan struct{}, 1)}
+}
+
+// fileLocks hands out per file locks and keeps track of which files are in use.
+type fileLocks struct {
+	mu    sync.Mutex
+	locks map[string]*fileLock
+}
+
+var FileLocks = newFileLocks()
+
+func newFileLocks() *fileLocks {
+	return &fileLocks{locks: make(map[string]*fileLock)}
+}
+
+// Lock blocks until filename is no longer used by anyone else.
+func (l *fileLocks) Lock(filename string) {
+	l.LockTimeout(filename, 0)
+}
+
+// LockTimeout is like Lock, but gives up once filename was used by someone else for longer than timeout, unless
+// timeout is 0. It reports whether the lock was acquired.
+func (l *fileLocks) LockTimeout(filename string, timeout time.Duration) bool {
+	l.mu.Lock()
+	lock, ok := l.locks[filename]
+	if !ok {
+		lock = newFileLock()
+		l.locks[filename] = lock
+	}
+	lock.refCount++
+	l.mu.Unlock()
+
+	if timeout == 0 {
+		lock.held <- struct{}{}
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case lock.held <- struct{}{}:
+		return true
+	case <-timer.C:
+		l.mu.Lock()
+		lock.refCount--
+		if lock.refCount == 0 {
+			delete(l.locks, filename)
+		}
+		l.mu.Unlock()
+		return false
+	}
+}
+
+// TryLock locks filename only if nobody is using or waiting for it.
+func (l *fileLocks) TryLock(filename string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.locks[filename]; ok {
+		return false
+	}
+	lock := newFileLock()
+	lock.refCount = 1
+	lock.held <- struct{}{}
+	l.locks[filename] = lock
+	return true
+}
+
+func (l *fileLocks) Unlock(filename string) {
+	l.mu.Lock()
+	lock := l.locks[filename]
+	lock.refCount--
+	if lock.refCount == 0 {
+		delete(l.locks, filename)
+	}
+	l.mu.Unlock()
+
+	<-lock.held
+}
+
+// Users returns the number of requests using or waiting for filename.
+func (l *fileLocks) Users(filename string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lock, ok := l.locks[filename]; ok {
+		return lock.refCount
+	}
+	return 0
+}
+
+// Waiting returns the number of requests waiting for a file used by someone else.
+func (l *fileLocks) Waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var waiting int
+	for _, lock := range l.locks {
+		waiting += lock.refCount - 1
+	}
+	return waiting
+}
+
+// Keys returns a snapshot of all files currently in use.
+func (l *fileLocks) Keys() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := make([]string, 0, len(l.locks))
+	for filename := range l.locks {
+		keys = append(keys, filename)
+	}
+	return keys
+}
+
+// cacheFile is a file in the cache, named by its path relative to the cache directory.
+type cacheFile struct {
+	os.FileInfo
+	Path string
+}
+
+// walkCache lists all regular files in the cache, either the completely cached ones or the temp files.
+func walkCache(temp bool) ([]cacheFile, error) {
+	cacheDir := GetSettings().CacheDir
+	var files []cacheFile
+	err := filepath.Walk(cacheDir, func(filename string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Renamed or removed by a concurrent download or eviction.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.IsDir() && (fi.Name() == objectsDir || fi.Name() == metaDir) {
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), ".") == temp {
+			rel, err := filepath.Rel(cacheDir, filename)
+			if err != nil {
+				return err
+			}
+			files = append(files, cacheFile{fi, filepath.ToSlash(rel)})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// cachedFiles lists all completely cached files, skipping temp files of running downloads.
+func cachedFiles() ([]cacheFile, error) {
+	return walkCache(false)
+}
+
+// removeTempFiles removes the temp files of downloads which were interrupted.
+func removeTempFiles() {
+	files, err := walkCache(true)
+	if err != nil {
+		errorf("", "Local", "Could not list cache: %s", err)
+		return
+	}
+	for _, fi := range files {
+		if err := os.Remove(path.Join(GetSettings().CacheDir, fi.Path)); err != nil {
+			errorf("", "Local", "Could not remove temp file: %s", err)
+		} else {
+			logf(fi.Name()[1:], "Local", "Removed incomplete temp file")
+		}
+	}
+}
+
+// checkCacheDir makes sure the cache directory, if it exists already, is a directory which can be listed.
+func checkCacheDir() error {
+	cacheDir := GetSettings().CacheDir
+	fi, err := os.Stat(cacheDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("cache path %s is not a directory", cacheDir)
+	}
+	dir, err := os.Open(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// misplacedFiles lists the entries of the cache directory which don't fit its layout, e.g. a file where the
+// directory of a repository or architecture belongs. Databases are kept below $repo/$arch in both layouts,
+// packages either at the top with their repository and architecture prefixed or there as well.
+func misplacedFiles() ([]string, error) {
+	s := GetSettings()
+	var misplaced []string
+	err := filepath.Walk(s.CacheDir, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.CacheDir, filename)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if fi.IsDir() && (rel == objectsDir || rel == metaDir) {
+			return filepath.SkipDir
+		}
+		var ok bool
+		switch strings.Count(rel, "/") {
+		case 0:
+			// Without a repository and architecture, files of the generic path mode are kept at the top in either
+			// layout, as are temp files not belonging to a download, e.g. those of health checks.
+			// Packages cached at the top by older versions lack the prefix of the flat layout.
+			flat := (s.CacheLayout != "nested" && strings.Contains(rel, "%2F")) || s.PathMode == "generic" || strings.HasPrefix(rel, ".")
+			ok = fi.IsDir() || (fi.Mode().IsRegular() && flat)
+		case 1:
+			ok = fi.IsDir()
+		case 2:
+			ok = fi.Mode().IsRegular() && (s.CacheLayout == "nested" || isDBFile(rel) || strings.HasPrefix(path.Base(rel), "."))
+		}
+		if !ok {
+			misplaced = append(misplaced, rel)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	return misplaced, err
+}
+
+// repairCache moves the given misplaced entries of the cache directory to where the layout keeps them if they are
+// cached files of a known repository and architecture, e.g. those cached at the top by older versions, and removes
+// the others.
+func repairCache(misplaced []string) error {
+	cacheDir := GetSettings().CacheDir
+	moves := make(map[string]string)
+	for _, rel := range misplaced {
+		if name, ok := layoutName(rel); ok {
+			moves[rel] = name
+			continue
+		}
+		if err := os.RemoveAll(path.Join(cacheDir, rel)); err != nil {
+			return err
+		}
+		warnf(rel, "Local", "Removed misplaced entry from the cache")
+	}
+	// Files are only moved once the other entries are gone, as those may be in their way.
+	for _, rel := range misplaced {
+		name, ok := moves[rel]
+		if !ok {
+			continue
+		}
+		if err := os.MkdirAll(path.Dir(path.Join(cacheDir, name)), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(path.Join(cacheDir, rel), path.Join(cacheDir, name)); err != nil {
+			return err
+		}
+		if meta := loadMeta(rel); meta != (fileMeta{}) {
+			if err := saveMeta(name, meta); err != nil {
+				return err
+			}
+		}
+		removeMeta(rel)
+		warnf(name, "Local", "Moved misplaced file %s in the cache", rel)
+	}
+	return nil
+}
+
+// layoutName returns the name the cached file rel has in the layout of the cache, if its repository and
+// architecture are known.
+func layoutName(rel string) (string, bool) {
+	fi, err := os.Lstat(path.Join(GetSettings().CacheDir, rel))
+	if err != nil || !fi.Mode().IsRegular() || strings.HasPrefix(path.Base(rel), ".") {
+		return "", false
+	}
+	req := scrubRequest(rel)
+	if len(req.Repo) == 0 || len(req.Arch) == 0 {
+		return "", false
+	}
+	name := cacheName(&req)
+	return name, name != rel
+}
+
+// evictFiles removes the given cached files, skipping those in use. It never blocks on running
+// requests, files are only locked for the duration of their removal.
+func evictFiles(filenames []string) []string {
+	var evicted []string
+	for _, filename := range filenames {
+		if !FileLocks.TryLock(filename) {
+			continue
+		}
+		if err := os.Remove(path.Join(GetSettings().CacheDir, filename)); err == nil {
+			removeMeta(filename)
+			evicted = append(evicted, filename)
+		}
+		FileLocks.Unlock(filename)
+	}
+	if len(evicted) > 0 && GetSettings().Dedup {
+		pruneObjects()
+	}
+	return evicted
+}
+
+// byteSize is a size in bytes which can be given with a K, M, G or T suffix.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	size, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(size)
+	return nil
+}
+
+func parseSize(value string) (int64, error) {
+	value = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	multiplier := int64(1)
+	for i, unit := range "KMGT" {
+		if strings.HasSuffix(value, string(unit)) {
+			multiplier = 1 << (10 * uint(i+1))
+			value = strings.TrimSuffix(value, string(unit))
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid size, expected a number optionally followed by K, M, G or T")
+	}
+	return size * multiplier, nil
+}
+
+// accessIndexInterval is how often the access times are saved while the cache is kept between restarts.
+const accessIndexInterval = time.Minute
+
+// accessTimes records when cached files were last served.
+type accessTimes struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+	dirty bool
+}
+
+var AccessTimes = &accessTimes{times: make(map[string]time.Time)}
+
+func (a *accessTimes) Touch(filename string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.times[filename] = time.Now()
+	a.dirty = true
+}
+
+// Get returns the last access of filename, or fallback if it was not served since startup.
+func (a *accessTimes) Get(filename string, fallback time.Time) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t, ok := a.times[filename]; ok {
+		return t
+	}
+	return fallback
+}
+
+func (a *accessTimes) Remove(filename string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.times, filename)
+	a.dirty = true
+}
+
+// accessIndexPath returns where access times are kept between restarts. Cached files never start with a dot, so
+// the index can't clash with their metadata.
+func accessIndexPath() string {
+	return path.Join(GetSettings().CacheDir, metaDir, ".access.json")
+}
+
+// Save writes the access times to the index at filename if they changed since they were last saved or loaded.
+func (a *accessTimes) Save(filename string) error {
+	a.mu.Lock()
+	if !a.dirty {
+		a.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(a.times)
+	a.dirty = false
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
+		return err
+	}
+	// A crash while writing must not leave a truncated index behind.
+	if err := ioutil.WriteFile(filename+".tmp", data, 0600); err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		a.mu.Lock()
+		a.dirty = true
+		a.mu.Unlock()
+	}
+	return err
+}
+
+// Load reads the access times from the index at filename, skipping files which are no longer cached.
+func (a *accessTimes) Load(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var times map[string]time.Time
+	if err := json.Unmarshal(data, &times); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for cached, t := range times {
+		if _, err := os.Stat(path.Join(GetSettings().CacheDir, cached)); err == nil {
+			a.times[cached] = t
+		}
+	}
+	return nil
+}
+
+// runAccessIndex periodically saves the access times, so that eviction keeps its order across restarts.
+func runAccessIndex() {
+	for range time.Tick(accessIndexInterval) {
+		if err := AccessTimes.Save(accessIndexPath()); err != nil {
+			errorf("", "Local", "Could not save access times: %s", err)
+		}
+	}
+}
+
+// minFreeSpace is kept free on the cache file system in addition to the files being downloaded.
+var minFreeSpace int64 = 64 << 20
+
+// hasSpaceFor reports whether size more bytes fit into the cache, assuming so if the free space is unknown.
+func hasSpaceFor(size int64) bool {
+	free, ok := diskFree(GetSettings().CacheDir)
+	return !ok || size < 0 || free >= size+minFreeSpace
+}
+
+// suffixList is a list of file suffixes separated by commas, which may be given repeatedly.
+type suffixList []string
+
+func (l *suffixList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *suffixList) Set(value string) error {
+	for _, suffix := range strings.Split(value, ",") {
+		suffix = strings.TrimSpace(suffix)
+		if len(suffix) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(suffix, ".") {
+			return fmt.Errorf("invalid suffix %q, expected it to start with a dot", suffix)
+		}
+		*l = append(*l, suffix)
+	}
+	return nil
+}
+
+// isDBFile reports whether filename is a repository database or similar file which changes upstream under the same
+// name. These are checked for freshness on every request and never evicted.
+func isDBFile(filename string) bool {
+	for _, suffix := range GetSettings().NoCacheSuffixes {
+		if strings.HasSuffix(filename, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+var evictionMutex sync.Mutex
+
+// enforceCacheLimits evicts the least recently accessed files until the cache fits into its size and entry limits.
+func enforceCacheLimits() {
+	s := GetSettings()
+	if s.MaxCacheSize <= 0 && s.MaxCacheEntries <= 0 {
+		return
+	}
+	evictionMutex.Lock()
+	defer evictionMutex.Unlock()
+
+	files, err := cachedFiles()
+	if err != nil {
+		errorf("", "Eviction", "Could not list cache: %s", err)
+		return
+	}
+	var total int64
+	count := len(files)
+	candidates := files[:0]
+	for _, fi := range files {
+		total += fi.Size()
+		if !isDBFile(fi.Path) {
+			candidates = append(candidates, fi)
+		}
+	}
+	exceeded := func() bool {
+		return (s.MaxCacheSize > 0 && total > s.MaxCacheSize) || (s.MaxCacheEntries > 0 && count > s.MaxCacheEntries)
+	}
+	if !exceeded() {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return AccessTimes.Get(candidates[i].Path, candidates[i].ModTime()).Before(AccessTimes.Get(candidates[j].Path, candidates[j].ModTime()))
+	})
+	sizes := make(map[string]int64)
+	var victims []string
+	for _, fi := range candidates {
+		if !exceeded() {
+			break
+		}
+		victims = append(victims, fi.Path)
+		sizes[fi.Path] = fi.Size()
+		total -= fi.Size()
+		count--
+	}
+	for _, filename := range evictFiles(victims) {
+		AccessTimes.Remove(filename)
+		logf(filename, "Eviction", "Evicted %d bytes", sizes[filename])
+	}
+}
+
+// startTime stands in for the last access of files which were not served since startup.
+var startTime = time.Now()
+
+// janitorInterval is how often the cache is checked for files exceeding their maximum age.
+const janitorInterval = 10 * time.Minute
+
+// purgeExpiredFiles removes cached packages which were not accessed for longer than maxAge, skipping those in use.
+// Repository databases are kept like for size based eviction.
+func purgeExpiredFiles(maxAge time.Duration) {
+	files, err := cachedFiles()
+	if err != nil {
+		errorf("", "Janitor", "Could not list cache: %s", err)
+		return
+	}
+	var expired []string
+	for _, fi := range files {
+		if !isDBFile(fi.Path) && time.Since(AccessTimes.Get(fi.Path, startTime)) > maxAge {
+			expired = append(expired, fi.Path)
+		}
+	}
+	for _, filename := range evictFiles(expired) {
+		AccessTimes.Remove(filename)
+		logf(filename, "Janitor", "Removed file not accessed for %s", maxAge)
+	}
+}
+
+// runJanitor periodically purges expired files while a maximum age is configured.
+func runJanitor() {
+	for range time.Tick(janitorInterval) {
+		if maxAge := GetSettings().MaxAge; maxAge > 0 {
+			purgeExpiredFiles(maxAge)
+		}
+	}
+}
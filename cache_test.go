@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEvictFilesSkipsFilesInUse(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+
+	for _, filename := range []string{"foo.pkg.tar.xz", "bar.pkg.tar.xz"} {
+		if err := ioutil.WriteFile(path.Join(cacheDir, filename), []byte(testPackage), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	FileLocks.Lock("foo.pkg.tar.xz")
+	evicted := evictFiles([]string{"foo.pkg.tar.xz", "bar.pkg.tar.xz"})
+	FileLocks.Unlock("foo.pkg.tar.xz")
+
+	if len(evicted) != 1 || evicted[0] != "bar.pkg.tar.xz" {
+		t.Error("Only the unused file should have been evicted")
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "foo.pkg.tar.xz")); err != nil {
+		t.Error("File in use was deleted")
+	}
+	if len(FileLocks.Keys()) != 0 {
+		t.Error("Locks were not released")
+	}
+}
+
+func TestEvictFilesDuringDownloads(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			files, err := cachedFiles()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			filenames := make([]string, len(files))
+			for i, fi := range files {
+				filenames[i] = fi.Path
+			}
+			evictFiles(filenames)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				rec := httptest.NewRecorder()
+				url := fmt.Sprintf("/extra/os/x86_64/foo%d-1.0-1-x86_64.pkg.tar.xz", (i+j)%4)
+				handler(rec, httptest.NewRequest("GET", url, nil))
+				if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+					t.Errorf("Request for %s failed with %d", url, rec.Code)
+				}
+			}
+		}(i)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Requests deadlocked with eviction")
+	}
+	close(done)
+	<-stopped
+}
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{"1024": 1024, "500M": 500 << 20, "10G": 10 << 30, "2kb": 2048} {
+		if size, err := parseSize(value); err != nil || size != expected {
+			t.Errorf("Parsed size of %q does not match", value)
+		}
+	}
+	if _, err := parseSize("10X"); err == nil {
+		t.Error("Parsing size should have failed")
+	}
+}
+
+func TestEnforceCacheLimits(t *testing.T) {
+	for _, limit := range []func(*Settings){
+		func(s *Settings) { s.MaxCacheSize = 3000 },
+		func(s *Settings) { s.MaxCacheEntries = 3 },
+	} {
+		cacheDir := setupTestCache(t)
+		updateSettings(limit)
+
+		filenames := []string{"core.db", "old.pkg.tar.xz", "used.pkg.tar.xz", "new.pkg.tar.xz"}
+		for i, filename := range filenames {
+			if err := ioutil.WriteFile(path.Join(cacheDir, filename), make([]byte, 1000), 0600); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Now().Add(time.Duration(i-len(filenames)) * time.Hour)
+			os.Chtimes(path.Join(cacheDir, filename), mtime, mtime)
+		}
+		if err := ioutil.WriteFile(path.Join(cacheDir, ".downloading.pkg.tar.xz"), make([]byte, 1000), 0600); err != nil {
+			t.Fatal(err)
+		}
+		AccessTimes.Touch("used.pkg.tar.xz")
+
+		enforceCacheLimits()
+
+		for _, filename := range append(filenames, ".downloading.pkg.tar.xz") {
+			_, err := os.Stat(path.Join(cacheDir, filename))
+			if evicted := os.IsNotExist(err); evicted != (filename == "old.pkg.tar.xz") {
+				t.Errorf("Unexpected eviction state of %s with settings %+v", filename, GetSettings())
+			}
+		}
+		os.RemoveAll(cacheDir)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+
+	for _, filename := range []string{".foo.pkg.tar.xz", "bar.pkg.tar.xz"} {
+		if err := ioutil.WriteFile(path.Join(cacheDir, filename), []byte(testPackage), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removeTempFiles()
+
+	if _, err := os.Stat(path.Join(cacheDir, ".foo.pkg.tar.xz")); !os.IsNotExist(err) {
+		t.Error("Temp file was not removed")
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "bar.pkg.tar.xz")); err != nil {
+		t.Error("Cached file was removed")
+	}
+}
+
+func TestCheckCacheDir(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+
+	if err := checkCacheDir(); err != nil {
+		t.Errorf("Cache directory was rejected: %s", err)
+	}
+	os.RemoveAll(cacheDir)
+	if err := checkCacheDir(); err != nil {
+		t.Errorf("Missing cache directory was rejected: %s", err)
+	}
+	ioutil.WriteFile(cacheDir, []byte(testPackage), 0600)
+	if err := checkCacheDir(); err == nil {
+		t.Error("File in place of the cache directory was accepted")
+	}
+}
+
+func TestMisplacedFiles(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+
+	for _, filename := range []string{"extra%2Fx86_64%2Ffoo.pkg.tar.xz", ".healthz1", "core/x86_64/core.db", "extra/x86_64", "community/x86_64/sub/foo.pkg.tar.xz", ".meta/foo.pkg.tar.xz.json"} {
+		os.MkdirAll(path.Dir(path.Join(cacheDir, filename)), 0700)
+		if err := ioutil.WriteFile(path.Join(cacheDir, filename), []byte(testPackage), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	misplaced, err := misplacedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(misplaced, " ") != "community/x86_64/sub extra/x86_64" {
+		t.Errorf("Misplaced entries in the flat layout are %v", misplaced)
+	}
+
+	updateSettings(func(s *Settings) { s.CacheLayout = "nested" })
+	misplaced, _ = misplacedFiles()
+	if strings.Join(misplaced, " ") != "community/x86_64/sub extra/x86_64 extra%2Fx86_64%2Ffoo.pkg.tar.xz" {
+		t.Errorf("Misplaced entries in the nested layout are %v", misplaced)
+	}
+	if err := repairCache(misplaced); err != nil {
+		t.Fatal(err)
+	}
+	if misplaced, _ = misplacedFiles(); len(misplaced) > 0 {
+		t.Errorf("Entries %v were not removed", misplaced)
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "extra/x86_64/foo.pkg.tar.xz")); err != nil {
+		t.Error("Package was not moved below its repository and architecture")
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "core/x86_64/core.db")); err != nil {
+		t.Error("Database was removed")
+	}
+
+	updateSettings(func(s *Settings) { s.PathMode = "generic" })
+	if err := ioutil.WriteFile(path.Join(cacheDir, "pool%2Fmain%2Ffoo_1.0_amd64.deb"), []byte(testPackage), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if misplaced, _ = misplacedFiles(); len(misplaced) > 0 {
+		t.Errorf("Files of the generic path mode in the nested layout were considered misplaced: %v", misplaced)
+	}
+}
+
+func TestRepairCacheOldFlatLayout(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+
+	// Older versions kept packages and databases at the top, recording their repository and architecture.
+	for filename, meta := range map[string]fileMeta{
+		"foo-1.0-1-x86_64.pkg.tar.xz":              {ETag: `"foo"`, Repo: "extra", Arch: "x86_64"},
+		"core.db":                                  {Repo: "core", Arch: "x86_64"},
+		"unknown-1.0-1-x86_64.pkg.tar.xz":          {},
+		"extra/x86_64/bar-1.0-1-x86_64.pkg.tar.xz": {},
+	} {
+		os.MkdirAll(path.Dir(path.Join(cacheDir, filename)), 0700)
+		if err := ioutil.WriteFile(path.Join(cacheDir, filename), []byte(testPackage), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if meta != (fileMeta{}) {
+			saveMeta(filename, meta)
+		}
+	}
+	misplaced, err := misplacedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(misplaced, " ") != "core.db extra/x86_64/bar-1.0-1-x86_64.pkg.tar.xz foo-1.0-1-x86_64.pkg.tar.xz unknown-1.0-1-x86_64.pkg.tar.xz" {
+		t.Errorf("Misplaced entries of an older flat cache are %v", misplaced)
+	}
+	if err := repairCache(misplaced); err != nil {
+		t.Fatal(err)
+	}
+	if misplaced, _ = misplacedFiles(); len(misplaced) > 0 {
+		t.Errorf("Entries %v were not repaired", misplaced)
+	}
+	for filename, kept := range map[string]bool{
+		"extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz": true,
+		"extra%2Fx86_64%2Fbar-1.0-1-x86_64.pkg.tar.xz": true,
+		"core/x86_64/core.db":                          true,
+		"unknown-1.0-1-x86_64.pkg.tar.xz":              false,
+	} {
+		if _, err := os.Stat(path.Join(cacheDir, filename)); (err == nil) != kept {
+			t.Errorf("%s: expected kept = %t", filename, kept)
+		}
+	}
+	if meta := loadMeta("extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz"); meta.ETag != `"foo"` {
+		t.Error("Metadata was not moved along with the package")
+	}
+}
+
+func TestHandleRequestDiskFull(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	if _, ok := diskFree(cacheDir); !ok {
+		t.Skip("Free space can't be determined on this platform")
+	}
+
+	defer func(margin int64) { minFreeSpace = margin }(minFreeSpace)
+	minFreeSpace = 1 << 62
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+		t.Error("File was not forwarded")
+	}
+	if entries, _ := ioutil.ReadDir(cacheDir); len(entries) != 0 {
+		t.Error("File was cached although the disk is full")
+	}
+}
+
+func TestPurgeExpiredFiles(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+	for _, filename := range []string{"old.pkg.tar.xz", "used.pkg.tar.xz", "new.pkg.tar.xz", "extra/x86_64/extra.db"} {
+		os.MkdirAll(path.Dir(path.Join(cacheDir, filename)), 0700)
+		if err := ioutil.WriteFile(path.Join(cacheDir, filename), []byte(testPackage), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	AccessTimes.mu.Lock()
+	AccessTimes.times["old.pkg.tar.xz"] = time.Now().Add(-2 * time.Hour)
+	AccessTimes.times["used.pkg.tar.xz"] = time.Now().Add(-2 * time.Hour)
+	AccessTimes.times["extra/x86_64/extra.db"] = time.Now().Add(-2 * time.Hour)
+	AccessTimes.mu.Unlock()
+	AccessTimes.Touch("new.pkg.tar.xz")
+
+	FileLocks.Lock("used.pkg.tar.xz")
+	purgeExpiredFiles(time.Hour)
+	FileLocks.Unlock("used.pkg.tar.xz")
+
+	for filename, kept := range map[string]bool{"old.pkg.tar.xz": false, "used.pkg.tar.xz": true, "new.pkg.tar.xz": true, "extra/x86_64/extra.db": true} {
+		if _, err := os.Stat(path.Join(cacheDir, filename)); (err == nil) != kept {
+			t.Errorf("%s: expected kept = %t", filename, kept)
+		}
+	}
+}
+
+func TestIsDBFile(t *testing.T) {
+	defer SetSettings(GetSettings())
+	var suffixes suffixList
+	if err := suffixes.Set(".db, .files"); err != nil {
+		t.Fatal(err)
+	}
+	if err := suffixes.Set("db.sig"); err == nil {
+		t.Error("Suffix without a dot should be rejected")
+	}
+	SetSettings(&Settings{NoCacheSuffixes: suffixes})
+
+	for filename, expected := range map[string]bool{
+		"core.db":                     true,
+		"core.files":                  true,
+		"core.db.sig":                 false,
+		"foo-1.0-1-x86_64.pkg.tar.xz": false,
+	} {
+		if isDBFile(filename) != expected {
+			t.Errorf("%s: expected isDBFile = %t", filename, expected)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.CacheLayout = "nested"; s.Dedup = true })
+
+	for _, repo := range []string{"testing", "extra"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+repo+"/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	}
+	testingFile := path.Join(cacheDir, "testing", "x86_64", "foo-1.0-1-x86_64.pkg.tar.xz")
+	extraFile := path.Join(cacheDir, "extra", "x86_64", "foo-1.0-1-x86_64.pkg.tar.xz")
+	fi1, err1 := os.Stat(testingFile)
+	fi2, err2 := os.Stat(extraFile)
+	if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+		t.Fatal("Identical files were not linked")
+	}
+	if files, _ := cachedFiles(); len(files) != 2 {
+		t.Errorf("Objects should not be listed as cached files, got %d files", len(files))
+	}
+
+	if _, ok := linkCount(fi1); !ok {
+		t.Skip("Link counts can't be determined on this platform")
+	}
+	evictFiles([]string{"testing/x86_64/foo-1.0-1-x86_64.pkg.tar.xz"})
+	if objects, _ := ioutil.ReadDir(path.Join(cacheDir, objectsDir)); len(objects) != 1 {
+		t.Error("Object still linked to was removed")
+	}
+	evictFiles([]string{"extra/x86_64/foo-1.0-1-x86_64.pkg.tar.xz"})
+	if objects, _ := ioutil.ReadDir(path.Join(cacheDir, objectsDir)); len(objects) != 0 {
+		t.Error("Unused object was not removed")
+	}
+}
+
+func TestFileLocksLockTimeout(t *testing.T) {
+	locks := newFileLocks()
+	if !locks.LockTimeout("foo.pkg.tar.xz", time.Millisecond) {
+		t.Fatal("Unused file could not be locked")
+	}
+	if locks.LockTimeout("foo.pkg.tar.xz", 10*time.Millisecond) {
+		t.Error("File in use was locked")
+	}
+	if users := locks.Users("foo.pkg.tar.xz"); users != 1 {
+		t.Errorf("Request which gave up still counts, %d users", users)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		locks.Unlock("foo.pkg.tar.xz")
+	}()
+	if !locks.LockTimeout("foo.pkg.tar.xz", time.Second) {
+		t.Error("File was not locked once it was released")
+	}
+	locks.Unlock("foo.pkg.tar.xz")
+	if len(locks.Keys()) != 0 {
+		t.Error("Locks were not released")
+	}
+}
+
+func TestAccessTimesSaveLoad(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+	for _, filename := range []string{"foo.pkg.tar.xz", "bar.pkg.tar.xz"} {
+		if err := ioutil.WriteFile(path.Join(cacheDir, filename), []byte(testPackage), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := &accessTimes{times: make(map[string]time.Time)}
+	saved.Touch("foo.pkg.tar.xz")
+	saved.Touch("bar.pkg.tar.xz")
+	saved.Touch("gone.pkg.tar.xz")
+	if err := saved.Save(accessIndexPath()); err != nil {
+		t.Fatal(err)
+	}
+	if saved.dirty {
+		t.Error("Access times are still marked as changed after saving")
+	}
+
+	loaded := &accessTimes{times: make(map[string]time.Time)}
+	if err := loaded.Load(accessIndexPath()); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{"foo.pkg.tar.xz", "bar.pkg.tar.xz"} {
+		if !loaded.Get(filename, time.Time{}).Equal(saved.Get(filename, time.Time{})) {
+			t.Errorf("Access time of %s was not restored", filename)
+		}
+	}
+	if !loaded.Get("gone.pkg.tar.xz", time.Time{}).IsZero() {
+		t.Error("Access time of file no longer cached was restored")
+	}
+	if files, _ := cachedFiles(); len(files) != 2 {
+		t.Errorf("Index is listed as a cached file: %v", files)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dbChecksums maps the package filenames listed in a repository database to their SHA256 sums.
+type dbChecksums struct {
+	modTime time.Time
+	sums    map[string]string
+}
+
+var checksumIndexes = make(map[string]*dbChecksums)
+var checksumIndexesMutex sync.Mutex
+
+// openDB opens a repository database, decompressing it if it is compressed with gzip or bzip2.
+func openDB(file *os.File) (io.Reader, error) {
+	r := bufio.NewReader(file)
+	magic, _ := r.Peek(3)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(r)
+	case string(magic) == "BZh":
+		return bzip2.NewReader(r), nil
+	}
+	return r, nil
+}
+
+// parseDesc reads the filename and SHA256 sum from the desc file of a package in a repository database.
+func parseDesc(r io.Reader) (filename string, sum string, err error) {
+	scanner := bufio.NewScanner(r)
+	var section string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			section = line
+		case len(line) == 0:
+			section = ""
+		case section == "%FILENAME%":
+			filename = line
+		case section == "%SHA256SUM%":
+			sum = strings.ToLower(line)
+		}
+	}
+	return filename, sum, scanner.Err()
+}
+
+// readDBChecksums reads the SHA256 sums of all packages in the repository database at dbPath.
+func readDBChecksums(dbPath string) (*dbChecksums, error) {
+	file, err := os.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, err := openDB(file)
+	if err != nil {
+		return nil, err
+	}
+	index := &dbChecksums{modTime: fi.ModTime(), sums: make(map[string]string)}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return index, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Base(hdr.Name) != "desc" {
+			continue
+		}
+		filename, sum, err := parseDesc(tr)
+		if err != nil {
+			return nil, err
+		}
+		if len(filename) > 0 && len(sum) > 0 {
+			index.sums[filename] = sum
+		}
+	}
+}
+
+// expectedChecksum looks up the SHA256 sum of a package in the cached database of its repository,
+// rereading the database whenever it was updated.
+func expectedChecksum(req *Request) (string, error) {
+	checksumIndexesMutex.Lock()
+	defer checksumIndexesMutex.Unlock()
+
+	dbPath := path.Join(GetSettings().CacheDir, cacheName(&Request{req.Repo, req.OS, req.Arch, req.Repo + ".db"}))
+	fi, err := os.Stat(dbPath)
+	if err != nil {
+		return "", err
+	}
+	index, ok := checksumIndexes[dbPath]
+	if !ok || !index.modTime.Equal(fi.ModTime()) {
+		index, err = readDBChecksums(dbPath)
+		if err != nil {
+			return "", err
+		}
+		checksumIndexes[dbPath] = index
+	}
+	sum, ok := index.sums[req.File]
+	if !ok {
+		return "", fmt.Errorf("%s is not listed in %s.db", req.File, req.Repo)
+	}
+	return sum, nil
+}
+
+// isDBArchive reports whether filename is a repository database archive which can be checked with checkDB.
+func isDBArchive(filename string) bool {
+	return strings.HasSuffix(filename, ".db") || strings.HasSuffix(filename, ".files")
+}
+
+// checkDB reads the repository database at dbPath to its end, so that truncated or otherwise damaged archives are
+// detected. Databases compressed with zstd can't be read and are assumed to be intact.
+func checkDB(dbPath string) error {
+	file, err := os.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 4)
+	if n, _ := io.ReadFull(file, magic); n == 4 && string(magic) == "\x28\xb5\x2f\xfd" {
+		return nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err := openDB(file)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return err
+		}
+	}
+	// Reading past the end of the archive makes gzip verify its trailer.
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// checkedDBs maps cached databases which passed checkDB to their modification time at that point.
+var checkedDBs = make(map[string]time.Time)
+var checkedDBsMutex sync.Mutex
+
+// checkCachedDB runs checkDB on the cached database at dbPath unless it already passed since it was last modified.
+func checkCachedDB(dbPath string) error {
+	checkedDBsMutex.Lock()
+	defer checkedDBsMutex.Unlock()
+
+	fi, err := os.Stat(dbPath)
+	if err != nil {
+		return err
+	}
+	if modTime, ok := checkedDBs[dbPath]; ok && modTime.Equal(fi.ModTime()) {
+		return nil
+	}
+	if err := checkDB(dbPath); err != nil {
+		delete(checkedDBs, dbPath)
+		return err
+	}
+	checkedDBs[dbPath] = fi.ModTime()
+	return nil
+}
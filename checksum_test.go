@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeTestDB writes a gzip compressed repository database listing the given packages and their contents.
+func writeTestDB(t *testing.T, filename string, packages map[string]string) {
+	if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gw := gzip.NewWriter(file)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+	for name, content := range packages {
+		sum := sha256.Sum256([]byte(content))
+		desc := "%FILENAME%\n" + name + "\n\n%SHA256SUM%\n" + hex.EncodeToString(sum[:]) + "\n\n"
+		tw.WriteHeader(&tar.Header{Name: name + "/desc", Mode: 0644, Size: int64(len(desc)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(desc))
+	}
+}
+
+func TestExpectedChecksum(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+	writeTestDB(t, path.Join(cacheDir, "extra/x86_64/extra.db"), map[string]string{"foo-1.0-1-x86_64.pkg.tar.xz": testPackage})
+
+	sum, err := expectedChecksum(&Request{"extra", "os", "x86_64", "foo-1.0-1-x86_64.pkg.tar.xz"})
+	expected := sha256.Sum256([]byte(testPackage))
+	if err != nil || sum != hex.EncodeToString(expected[:]) {
+		t.Errorf("Checksum %q (%v) does not match", sum, err)
+	}
+	if _, err := expectedChecksum(&Request{"extra", "os", "x86_64", "bar-1.0-1-x86_64.pkg.tar.xz"}); err == nil {
+		t.Error("Unlisted package should have no checksum")
+	}
+	if _, err := expectedChecksum(&Request{"core", "os", "x86_64", "foo-1.0-1-x86_64.pkg.tar.xz"}); err == nil {
+		t.Error("Package of an uncached database should have no checksum")
+	}
+}
+
+func TestHandleRequestVerifyChecksums(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".sig") {
+			w.Write([]byte("\x89signature"))
+			return
+		}
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.VerifyChecksums = true })
+	writeTestDB(t, path.Join(cacheDir, "extra/x86_64/extra.db"), map[string]string{
+		"good-1.0-1-x86_64.pkg.tar.xz": testPackage,
+		"bad-1.0-1-x86_64.pkg.tar.xz":  testPackage + "different",
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/good-1.0-1-x86_64.pkg.tar.xz", nil))
+	if _, err := os.Stat(path.Join(cacheDir, "extra%2Fx86_64%2Fgood-1.0-1-x86_64.pkg.tar.xz")); err != nil {
+		t.Error("Package with matching checksum was not cached")
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("Response with mismatching checksum was not aborted: %v", r)
+			}
+		}()
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/bad-1.0-1-x86_64.pkg.tar.xz", nil))
+	}()
+	if _, err := os.Stat(path.Join(cacheDir, "extra%2Fx86_64%2Fbad-1.0-1-x86_64.pkg.tar.xz")); err == nil {
+		t.Error("Package with mismatching checksum was cached")
+	}
+	if _, err := os.Stat(path.Join(cacheDir, ".extra%2Fx86_64%2Fbad-1.0-1-x86_64.pkg.tar.xz")); err == nil {
+		t.Error("Temp file of package with mismatching checksum was left behind")
+	}
+
+	// Signatures aren't listed in the database, so they are neither verified nor warned about.
+	buf, restore := captureLog()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/good-1.0-1-x86_64.pkg.tar.xz.sig", nil))
+	restore()
+	if rec.Body.String() != "\x89signature" || rec.Header().Get("Content-Length") != "10" {
+		t.Errorf("Signature was sent with Content-Length %q", rec.Header().Get("Content-Length"))
+	}
+	if strings.Contains(buf.String(), "Not verifying checksum") {
+		t.Error("Missing checksum of a signature was warned about")
+	}
+}
+
+func TestCheckDB(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+	dbPath := path.Join(cacheDir, "extra.db")
+	writeTestDB(t, dbPath, map[string]string{"foo-1.0-1-x86_64.pkg.tar.xz": testPackage})
+
+	if err := checkDB(dbPath); err != nil {
+		t.Errorf("Intact database failed the check: %s", err)
+	}
+	fi, _ := os.Stat(dbPath)
+	os.Truncate(dbPath, fi.Size()-4)
+	if err := checkDB(dbPath); err == nil {
+		t.Error("Truncated database passed the check")
+	}
+	ioutil.WriteFile(dbPath, []byte("\x28\xb5\x2f\xfdzstd"), 0644)
+	if err := checkDB(dbPath); err != nil {
+		t.Errorf("Database compressed with zstd failed the check: %s", err)
+	}
+}
+
+func TestHandleRequestVerifyDBs(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "pkgproxy-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbDir)
+	writeTestDB(t, path.Join(dbDir, "extra.db"), map[string]string{"foo-1.0-1-x86_64.pkg.tar.xz": testPackage})
+	db, err := ioutil.ReadFile(path.Join(dbDir, "extra.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/community.db") {
+			w.Write(db[:len(db)-4])
+			return
+		}
+		w.Header().Set("ETag", `"extra"`)
+		w.Write(db)
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.VerifyDBs = true })
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/extra.db", nil))
+	if _, err := os.Stat(path.Join(cacheDir, "extra/x86_64/extra.db")); err != nil {
+		t.Error("Intact database was not cached")
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("Response with truncated database was not aborted: %v", r)
+			}
+		}()
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/community/os/x86_64/community.db", nil))
+	}()
+	if _, err := os.Stat(path.Join(cacheDir, "community/x86_64/community.db")); err == nil {
+		t.Error("Truncated database was cached")
+	}
+
+	damaged := append([]byte{}, db...)
+	damaged[len(damaged)-5] ^= 0xff
+	ioutil.WriteFile(path.Join(cacheDir, "extra/x86_64/extra.db"), damaged, 0644)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/extra.db", nil))
+	if rec.Body.Len() != len(db) {
+		t.Errorf("Damaged cached database was served with %d instead of %d bytes", rec.Body.Len(), len(db))
+	}
+	if err := checkDB(path.Join(cacheDir, "extra/x86_64/extra.db")); err != nil {
+		t.Errorf("Damaged cached database was not replaced: %s", err)
+	}
+}
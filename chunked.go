@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// minChunkSize is the smallest part of a file worth fetching over a connection of its own.
+const minChunkSize = 1 << 20
+
+// chunk is a part of a file downloaded into a temp file, read back while it is still growing.
+type chunk struct {
+	mu      sync.Mutex
+	grown   *sync.Cond
+	file    *os.File
+	size    int64
+	written int64
+	read    int64
+	err     error
+}
+
+// wrote records n more bytes or the end of the download, waking up the reader.
+func (c *chunk) wrote(n int, err error) {
+	c.mu.Lock()
+	c.written += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.grown.Broadcast()
+}
+
+func (c *chunk) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	for c.read == c.written && c.err == nil {
+		c.grown.Wait()
+	}
+	available, err := c.written-c.read, c.err
+	c.mu.Unlock()
+	if available == 0 {
+		return 0, err
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := c.file.ReadAt(p, c.read)
+	c.read += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// chunkedBody reads a file fetched over several connections at once in order.
+type chunkedBody struct {
+	parts  []io.Reader
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	chunks []*chunk
+}
+
+// chunkCount returns over how many connections the file answered with resp is downloaded,
+// only files whose size is known and whose upstream accepts ranges being split.
+func chunkCount(resp *http.Response, conns int) int {
+	if conns <= 1 || resp.ContentLength < 2*minChunkSize || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return 1
+	}
+	if len(resp.Header.Get("Content-Encoding")) > 0 || (len(resp.Header.Get("ETag")) == 0 && len(resp.Header.Get("Last-Modified")) == 0) {
+		return 1
+	}
+	if max := resp.ContentLength / minChunkSize; int64(conns) > max {
+		return int(max)
+	}
+	return conns
+}
+
+// newChunkedBody splits the file answered with resp into n parts, fetching each of them with a ranged request to the
+// same host. The parts are checked against the version of resp with If-Range. The body of resp is closed right away,
+// so that upstream stops sending the whole file, instead of keeping its connection busy after the first part.
+func newChunkedBody(ctx context.Context, resp *http.Response, n int) (*chunkedBody, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	b := &chunkedBody{cancel: cancel}
+	size := resp.ContentLength / int64(n)
+	validator := resp.Header.Get("ETag")
+	if len(validator) == 0 || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	for i := 0; i < n; i++ {
+		start, end := int64(i)*size, int64(i+1)*size
+		if i == n-1 {
+			end = resp.ContentLength
+		}
+		file, err := ioutil.TempFile(GetSettings().CacheDir, ".chunk")
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		c := &chunk{file: file, size: end - start}
+		c.grown = sync.NewCond(&c.mu)
+		b.chunks = append(b.chunks, c)
+		b.parts = append(b.parts, c)
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			fetchChunk(ctx, resp.Request.URL.String(), validator, start, c)
+		}()
+	}
+	resp.Body.Close()
+	return b, nil
+}
+
+// fetchChunk downloads the bytes of url from start on into c.
+func fetchChunk(ctx context.Context, url string, validator string, start int64, c *chunk) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		c.wrote(0, err)
+		return
+	}
+	s := GetSettings()
+	if len(s.UpstreamUser) > 0 {
+		req.SetBasicAuth(s.UpstreamUser, s.UpstreamPass)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+c.size-1))
+	req.Header.Set("If-Range", validator)
+	resp, err := UpstreamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		c.wrote(0, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", start)) {
+		c.wrote(0, fmt.Errorf("host answered range request with %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode)))
+		return
+	}
+	body := newUpstreamReader(io.LimitReader(resp.Body, c.size))
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := c.file.WriteAt(buf[:n], written); err != nil {
+				c.wrote(0, err)
+				return
+			}
+			written += int64(n)
+		}
+		if err == io.EOF && written < c.size {
+			err = io.ErrUnexpectedEOF
+		}
+		c.wrote(n, err)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	for len(b.parts) > 0 {
+		n, err := b.parts[0].Read(p)
+		if err == io.EOF {
+			b.parts = b.parts[1:]
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// Close stops all downloads and removes their temp files.
+func (b *chunkedBody) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	for _, c := range b.chunks {
+		c.file.Close()
+		os.Remove(c.file.Name())
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleRequestParallel(t *testing.T) {
+	content := bytes.Repeat([]byte(testPackage), 3*minChunkSize/len(testPackage)+1)
+	var ranges int32
+	ignoreRanges := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("Range")) > 0 {
+			atomic.AddInt32(&ranges, 1)
+			if ignoreRanges {
+				r.Header.Del("Range")
+			}
+		}
+		w.Header().Set("ETag", `"big"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.UpstreamParallel = 4 })
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/core/os/x86_64/big-1.0-1-x86_64.pkg.tar.xz", nil))
+	if !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Errorf("Parallel download was answered with %d instead of %d bytes", rec.Body.Len(), len(content))
+	}
+	if cached, err := ioutil.ReadFile(path.Join(cacheDir, "core%2Fx86_64%2Fbig-1.0-1-x86_64.pkg.tar.xz")); err != nil || !bytes.Equal(cached, content) {
+		t.Error("Parallel download was not cached correctly")
+	}
+	if ranges != 3 {
+		t.Errorf("File was split into %d ranged requests instead of 3, one per part", ranges)
+	}
+
+	ignoreRanges = true
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("Response was not aborted after a range request failed: %v", r)
+			}
+		}()
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/core/os/x86_64/big-2.0-1-x86_64.pkg.tar.xz", nil))
+	}()
+	if _, err := os.Stat(path.Join(cacheDir, "core%2Fx86_64%2Fbig-2.0-1-x86_64.pkg.tar.xz")); err == nil {
+		t.Error("File was cached although a range request failed")
+	}
+	if files, _ := walkCache(true); len(files) > 0 {
+		t.Errorf("Temp files were left behind: %v", files)
+	}
+}
+
+func TestChunkCount(t *testing.T) {
+	resp := &http.Response{ContentLength: 10 * minChunkSize, Header: http.Header{"Accept-Ranges": {"bytes"}, "Etag": {`"x"`}}}
+	if n := chunkCount(resp, 4); n != 4 {
+		t.Errorf("Large file was split into %d parts", n)
+	}
+	resp.ContentLength = 3 * minChunkSize
+	if n := chunkCount(resp, 4); n != 3 {
+		t.Errorf("File of 3 chunks was split into %d parts", n)
+	}
+	resp.ContentLength = minChunkSize
+	if n := chunkCount(resp, 4); n != 1 {
+		t.Errorf("Small file was split into %d parts", n)
+	}
+	resp.ContentLength = 10 * minChunkSize
+	resp.Header.Del("Accept-Ranges")
+	if n := chunkCount(resp, 4); n != 1 {
+		t.Errorf("File without range support was split into %d parts", n)
+	}
+}
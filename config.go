@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// configEntry is a single setting read from a config file, named like the flag it corresponds to.
+type configEntry struct {
+	Key    string
+	Values []string
+	Line   int
+}
+
+// closingQuote returns the index of the quote terminating the string s starts with.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		if s[0] == '"' && s[i] == '\\' {
+			i++
+		} else if s[i] == s[0] {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitArray splits the items of a single line TOML array.
+func splitArray(s string) ([]string, error) {
+	var items []string
+	for s = strings.TrimSpace(s); len(s) > 0; {
+		if s[0] == '"' || s[0] == '\'' {
+			end := closingQuote(s)
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			rest := strings.TrimSpace(s[end+1:])
+			if len(rest) > 0 && rest[0] != ',' {
+				return nil, errors.New("expected , between array items")
+			}
+			items = append(items, s[:end+1])
+			s = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+			continue
+		}
+		end := strings.IndexByte(s, ',')
+		if end < 0 {
+			items = append(items, s)
+			break
+		}
+		items = append(items, strings.TrimSpace(s[:end]))
+		s = strings.TrimSpace(s[end+1:])
+	}
+	return items, nil
+}
+
+// parseConfigValue parses a TOML value: a basic or literal string, a bare value or an array thereof.
+func parseConfigValue(value string) ([]string, error) {
+	if strings.HasPrefix(value, "[") {
+		if !strings.HasSuffix(value, "]") {
+			return nil, errors.New("unterminated array")
+		}
+		items, err := splitArray(value[1 : len(value)-1])
+		if err != nil {
+			return nil, err
+		}
+		var values []string
+		for _, item := range items {
+			parsed, err := parseConfigValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, parsed...)
+		}
+		return values, nil
+	}
+	if strings.HasPrefix(value, "\"") {
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string %s", value)
+		}
+		return []string{s}, nil
+	}
+	if strings.HasPrefix(value, "'") {
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return nil, errors.New("unterminated string")
+		}
+		return []string{value[1 : len(value)-1]}, nil
+	}
+	if len(value) == 0 {
+		return nil, errors.New("missing value")
+	}
+	return []string{value}, nil
+}
+
+// stripComment removes a trailing comment, ignoring # characters inside of strings.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// loadConfig reads a config file consisting of TOML key/value pairs, e.g.
+//
+//	keep-cache = true
+//	upstream = [
+//	    "https://mirror.one/$repo/os/$arch",
+//	    "https://mirror.two/$repo/os/$arch",
+//	]
+func loadConfig(filename string) ([]configEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []configEntry
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.Trim(strings.TrimSpace(parts[0]), "\"")
+		value := strings.TrimSpace(parts[1])
+		start := n
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") && scanner.Scan() {
+			n++
+			value += " " + strings.TrimSpace(stripComment(scanner.Text()))
+			value = strings.TrimSpace(value)
+		}
+		values, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", start, err)
+		}
+		entries = append(entries, configEntry{key, values, start})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// applyConfig sets the flags named by the config entries, flags given on the command line take precedence.
+func applyConfig(flags *flag.FlagSet, entries []configEntry) error {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, entry := range entries {
+		if flags.Lookup(entry.Key) == nil || entry.Key == "config" {
+			return fmt.Errorf("line %d: unknown setting %q", entry.Line, entry.Key)
+		}
+		if explicit[entry.Key] {
+			continue
+		}
+		for _, value := range entry.Values {
+			if err := flags.Set(entry.Key, value); err != nil {
+				return fmt.Errorf("line %d: invalid value for %q: %s", entry.Line, entry.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// upstreamPlaceholder matches the placeholders of an upstream template.
+var upstreamPlaceholder = regexp.MustCompile(`\$[a-zA-Z]+`)
+
+// validateUpstream makes sure an upstream template can tell repositories and architectures apart and only uses
+// known placeholders. With -path-mode generic, upstream is a plain URL without any placeholders.
+func validateUpstream(upstream string, pathMode string) error {
+	if pathMode == "generic" {
+		if placeholder := upstreamPlaceholder.FindString(upstream); len(placeholder) > 0 {
+			return fmt.Errorf("upstream %q contains placeholder %s, which can't be used with -path-mode generic", upstream, placeholder)
+		}
+		return nil
+	}
+	for _, placeholder := range upstreamPlaceholder.FindAllString(upstream, -1) {
+		switch placeholder {
+		case "$repo", "$os", "$arch", "$file":
+		default:
+			return fmt.Errorf("upstream %q contains unknown placeholder %s, expected $repo, $os, $arch or $file", upstream, placeholder)
+		}
+	}
+	if !strings.Contains(upstream, "$repo") || !strings.Contains(upstream, "$arch") {
+		return fmt.Errorf("upstream %q must contain $repo and $arch", upstream)
+	}
+	return nil
+}
+
+// parseProxyURL parses the URL of an HTTP, HTTPS or SOCKS5 proxy.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+		return nil, fmt.Errorf("proxy %q must use http, https or socks5", rawURL)
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("proxy %q lacks a host", rawURL)
+	}
+	return u, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// objectsDir is the directory below the cache directory holding one hard link per distinct file content.
+const objectsDir = ".objects"
+
+// dedupFile shares the content of a cached file with identical files cached before, by replacing it with a hard link
+// to the object named by its SHA256 sum, or by creating that object if it is the first of its kind.
+func dedupFile(filename string, sum string) error {
+	cacheDir := GetSettings().CacheDir
+	if err := os.MkdirAll(path.Join(cacheDir, objectsDir), 0700); err != nil {
+		return err
+	}
+	objectPath := path.Join(cacheDir, objectsDir, sum)
+	if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+		return os.Link(path.Join(cacheDir, filename), objectPath)
+	}
+	if err := os.Link(objectPath, tempPath(filename)); err != nil {
+		return err
+	}
+	return os.Rename(tempPath(filename), path.Join(cacheDir, filename))
+}
+
+// pruneObjects removes objects which are no longer linked to by any cached file.
+func pruneObjects() {
+	dir := path.Join(GetSettings().CacheDir, objectsDir)
+	objects, err := filepath.Glob(path.Join(dir, "*"))
+	if err != nil {
+		return
+	}
+	for _, objectPath := range objects {
+		fi, err := os.Stat(objectPath)
+		if err != nil {
+			continue
+		}
+		if links, ok := linkCount(fi); ok && links == 1 {
+			if err := os.Remove(objectPath); err != nil {
+				errorf("", "Local", "Could not remove object: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package main
+
+// diskFree can't determine the free space on this platform.
+func diskFree(dir string) (int64, bool) {
+	return 0, false
+}
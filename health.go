@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readinessInterval is the time between checks whether upstream is reachable, so probes never reach upstream.
+const readinessInterval = 30 * time.Second
+
+// upstreamReachable is 1 if any mirror answered the last readiness check.
+var upstreamReachable int32
+
+// writableCheckInterval is how long the result of checking whether the cache is writable is reused, so that frequent
+// probes don't each create a file.
+const writableCheckInterval = 5 * time.Second
+
+// writableCheck is the result of the last check whether the cache directory dir is writable.
+var writableCheck struct {
+	mu  sync.Mutex
+	dir string
+	at  time.Time
+	err error
+}
+
+// cacheWritable returns the result of checkCacheWritable, checking again once writableCheckInterval passed.
+func cacheWritable() error {
+	writableCheck.mu.Lock()
+	defer writableCheck.mu.Unlock()
+	dir := GetSettings().CacheDir
+	if dir != writableCheck.dir || time.Since(writableCheck.at) >= writableCheckInterval {
+		writableCheck.dir, writableCheck.at, writableCheck.err = dir, time.Now(), checkCacheWritable()
+	}
+	return writableCheck.err
+}
+
+// checkCacheWritable creates and removes a temp file in the cache directory.
+func checkCacheWritable() error {
+	file, err := ioutil.TempFile(GetSettings().CacheDir, ".healthz")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkUpstream reports whether any mirror answers at all, local mirrors are always reachable.
+func checkUpstream() bool {
+	for _, mirror := range GetSettings().allMirrors() {
+		u, err := url.Parse(mirror.URL)
+		if err != nil {
+			continue
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return true
+		}
+		resp, err := UpstreamClient.Head(u.Scheme + "://" + u.Host + "/")
+		if err == nil {
+			resp.Body.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// runReadinessChecks periodically records whether upstream is reachable.
+func runReadinessChecks() {
+	for {
+		if checkUpstream() {
+			atomic.StoreInt32(&upstreamReachable, 1)
+		} else {
+			warnf("", "Upstream", "No mirror is reachable")
+			atomic.StoreInt32(&upstreamReachable, 0)
+		}
+		time.Sleep(readinessInterval)
+	}
+}
+
+// healthzHandler answers with 200 while the cache directory is writable, as last checked at most
+// writableCheckInterval ago.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := cacheWritable(); err != nil {
+		errorf("", "Health", "Cache is not writable: %s", err)
+		http.Error(w, "cache not writable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler answers with 200 while the cache directory is writable and upstream was reachable when last checked.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&upstreamReachable) == 0 {
+		http.Error(w, "upstream not reachable", http.StatusServiceUnavailable)
+		return
+	}
+	healthzHandler(w, r)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthzHandler(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Healthy proxy returned %d, expected 200", rec.Code)
+	}
+
+	// The result is reused for a while, so that frequent probes don't each create a file.
+	os.RemoveAll(cacheDir)
+	rec = httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Recently checked proxy returned %d, expected 200", rec.Code)
+	}
+	writableCheck.mu.Lock()
+	writableCheck.at = time.Time{}
+	writableCheck.mu.Unlock()
+	rec = httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Proxy whose cache directory was removed returned %d, expected 503", rec.Code)
+	}
+
+	setupCacheDir()
+	updateSettings(func(s *Settings) { s.CacheDir = path.Join(cacheDir, "missing") })
+	rec = httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Proxy without cache directory returned %d, expected 503", rec.Code)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+	defer atomic.StoreInt32(&upstreamReachable, 0)
+
+	if !checkUpstream() {
+		t.Error("Running upstream was not reachable")
+	}
+	atomic.StoreInt32(&upstreamReachable, 1)
+	rec := httptest.NewRecorder()
+	readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Ready proxy returned %d, expected 200", rec.Code)
+	}
+
+	upstream.Close()
+	if checkUpstream() {
+		t.Error("Closed upstream was reachable")
+	}
+	atomic.StoreInt32(&upstreamReachable, 0)
+	rec = httptest.NewRecorder()
+	readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Proxy without upstream returned %d, expected 503", rec.Code)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// linkCount can't determine the number of hard links on this platform.
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
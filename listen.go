@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks listen addresses naming a unix domain socket, e.g. unix:/run/pkgproxy.sock.
+const unixPrefix = "unix:"
+
+// socketMode allows the group of pkgproxy, e.g. that of a reverse proxy, to connect to its socket.
+const socketMode = 0660
+
+// listen opens the listener for addr, a TCP host:port or a unix socket path following unixPrefix. A socket left
+// behind by a previous run is replaced, one still in use by another process is not. Closing the listener removes
+// the socket again.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	socketPath := strings.TrimPrefix(addr, unixPrefix)
+	if fi, err := os.Lstat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, socketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
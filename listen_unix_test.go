@@ -0,0 +1,60 @@
+//go:build !plan9
+// +build !plan9
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgproxy-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := path.Join(dir, "pkgproxy.sock")
+
+	l, err := listen(unixPrefix + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(socketPath); err != nil || fi.Mode().Perm() != socketMode {
+		t.Errorf("Socket was not created with mode %o: %v", socketMode, err)
+	}
+	if _, err := listen(unixPrefix + socketPath); err == nil {
+		t.Error("Socket in use was replaced")
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Errorf("Could not connect to socket: %s", err)
+	} else {
+		conn.Close()
+	}
+	l.Close()
+	if _, err := os.Stat(socketPath); err == nil {
+		t.Error("Socket was not removed when the listener was closed")
+	}
+
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	l, err = listen(unixPrefix + socketPath)
+	if err != nil {
+		t.Errorf("Stale socket was not replaced: %s", err)
+	} else {
+		l.Close()
+	}
+
+	ioutil.WriteFile(socketPath, nil, 0644)
+	if _, err := listen(unixPrefix + socketPath); err == nil {
+		t.Error("Regular file was replaced by a socket")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// logLevel is the importance of a log message, messages below -log-level are not written.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, levelName := range logLevelNames {
+		if name == levelName {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("invalid -log-level %q, expected \"debug\", \"info\", \"warn\" or \"error\"", name)
+}
+
+// logEntry is a single log line, written as text or as JSON depending on -log-format.
+type logEntry struct {
+	Level      logLevel `json:"-"`
+	File       string   `json:"file,omitempty"`
+	Event      string   `json:"event"`
+	Status     int      `json:"status,omitempty"`
+	Bytes      int64    `json:"bytes,omitempty"`
+	DurationMs int64    `json:"duration_ms,omitempty"`
+	Message    string   `json:"message"`
+}
+
+// logf logs a message concerning file, which may be empty, tagged with the event it belongs to.
+func logf(file string, event string, format string, args ...interface{}) {
+	writeLog(logEntry{Level: levelInfo, File: file, Event: event, Message: fmt.Sprintf(format, args...)})
+}
+
+// debugf logs a message like logf, which is only of interest when debugging.
+func debugf(file string, event string, format string, args ...interface{}) {
+	writeLog(logEntry{Level: levelDebug, File: file, Event: event, Message: fmt.Sprintf(format, args...)})
+}
+
+// warnf logs a message like logf about something that went wrong but was dealt with.
+func warnf(file string, event string, format string, args ...interface{}) {
+	writeLog(logEntry{Level: levelWarn, File: file, Event: event, Message: fmt.Sprintf(format, args...)})
+}
+
+// errorf logs a message like logf about something that went wrong and needs attention.
+func errorf(file string, event string, format string, args ...interface{}) {
+	writeLog(logEntry{Level: levelError, File: file, Event: event, Message: fmt.Sprintf(format, args...)})
+}
+
+func writeLog(entry logEntry) {
+	s := GetSettings()
+	if entry.Level < s.LogLevel {
+		return
+	}
+	if s.LogFormat != "json" {
+		if len(entry.File) > 0 {
+			log.Printf("(%s)[%s] %s", entry.File, entry.Event, entry.Message)
+		} else {
+			log.Printf("[%s] %s", entry.Event, entry.Message)
+		}
+		return
+	}
+
+	entry.Event = strings.ToLower(entry.Event)
+	line, err := json.Marshal(struct {
+		Time     string `json:"time"`
+		Instance string `json:"instance,omitempty"`
+		Level    string `json:"level"`
+		logEntry
+	}{time.Now().UTC().Format(time.RFC3339Nano), s.InstanceName, entry.Level.String(), entry})
+	if err != nil {
+		log.Printf("[Log] %s", err)
+		return
+	}
+	log.Print(string(line))
+}
+
+// statusRecorder remembers the status code and the number of bytes sent through a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logRequest logs the outcome of a request once it was handled.
+func logRequest(file string, rec *statusRecorder, start time.Time) {
+	duration := time.Since(start)
+	writeLog(logEntry{
+		Level:      levelInfo,
+		File:       file,
+		Event:      "Done",
+		Status:     rec.status,
+		Bytes:      rec.bytes,
+		DurationMs: int64(duration / time.Millisecond),
+		Message:    fmt.Sprintf("Sent %d with %d bytes in %s", rec.status, rec.bytes, duration),
+	})
+}
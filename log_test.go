@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog redirects the log output into a buffer until the returned function is called.
+func captureLog() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	return &buf, func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}
+}
+
+func TestLogfText(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+	defer SetSettings(GetSettings())
+	updateSettings(func(s *Settings) { s.LogFormat = "text" })
+
+	logf("foo.pkg.tar.xz", "Local", "Successfully cached")
+	logf("", "Incoming", "Request for URL: %s", "/")
+	if buf.String() != "(foo.pkg.tar.xz)[Local] Successfully cached\n[Incoming] Request for URL: /\n" {
+		t.Errorf("Unexpected text log output %q", buf.String())
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	buf, restore := captureLog()
+	defer restore()
+	defer SetSettings(GetSettings())
+	updateSettings(func(s *Settings) {
+		s.LogFormat = "json"
+		s.LogLevel = levelWarn
+	})
+
+	debugf("foo.pkg.tar.xz", "Meta", "Serving cached version")
+	logf("foo.pkg.tar.xz", "Local", "Successfully cached")
+	warnf("foo.pkg.tar.xz", "Upstream", "Host responded with 503")
+	var entry struct {
+		Level string `json:"level"`
+		logEntry
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a single log line, got %q", buf.String())
+	}
+	if entry.Level != "warn" || entry.Message != "Host responded with 503" {
+		t.Errorf("Unexpected log entry %+v", entry)
+	}
+
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("Unknown log level was accepted")
+	}
+}
+
+func TestLogRequestJSON(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+	updateSettings(func(s *Settings) { s.LogFormat = "json"; s.InstanceName = "test" })
+
+	buf, restore := captureLog()
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	restore()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var entry struct {
+		Time     string `json:"time"`
+		Instance string `json:"instance"`
+		logEntry
+	}
+	for _, line := range lines {
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Log line %q is not valid JSON: %s", line, err)
+		}
+	}
+	if entry.Event != "done" || entry.File != "foo-1.0-1-x86_64.pkg.tar.xz" || entry.Instance != "test" || len(entry.Time) == 0 {
+		t.Errorf("Unexpected final log entry %+v", entry)
+	}
+	if entry.Status != http.StatusOK || entry.Bytes != int64(len(testPackage)) {
+		t.Errorf("Logged status %d with %d bytes, expected 200 with %d bytes", entry.Status, entry.Bytes, len(testPackage))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// lsTimeFormat is how times are shown by the ls command.
+const lsTimeFormat = "2006-01-02 15:04:05"
+
+// listCache writes the size, modification time, last access and repository of every cached file to w, ordered by
+// name, by size with the largest file first or by age with the least recently used file first, like on eviction.
+func listCache(w io.Writer, sortBy string) error {
+	files, err := cachedFiles()
+	if err != nil {
+		return err
+	}
+	switch sortBy {
+	case "name":
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	case "size":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Size() > files[j].Size() })
+	case "age":
+		sort.SliceStable(files, func(i, j int) bool {
+			return AccessTimes.Get(files[i].Path, files[i].ModTime()).Before(AccessTimes.Get(files[j].Path, files[j].ModTime()))
+		})
+	default:
+		return fmt.Errorf("invalid -sort %q, expected \"name\", \"size\" or \"age\"", sortBy)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tMODIFIED\tACCESSED\tREPO\tFILE")
+	var size int64
+	for _, fi := range files {
+		accessed := "-"
+		if t := AccessTimes.Get(fi.Path, time.Time{}); !t.IsZero() {
+			accessed = t.Format(lsTimeFormat)
+		}
+		repo := scrubRequest(fi.Path).Repo
+		if len(repo) == 0 {
+			repo = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", fi.Size(), fi.ModTime().Format(lsTimeFormat), accessed, repo, fi.Path)
+		size += fi.Size()
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%d files, %d bytes\n", len(files), size)
+	return err
+}
+
+// runLs implements the ls command, taking the same options as the proxy.
+func runLs(args []string) error {
+	flags := flag.NewFlagSet("pkgproxy ls", flag.ExitOnError)
+	sortBy := flags.String("sort", "name", "Order files by \"name\", \"size\" with the largest first or \"age\" with the least recently used first")
+	s, err := parseSettings(flags, args)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(s.CacheDir); err != nil {
+		return err
+	}
+
+	SetSettings(s)
+	if err := AccessTimes.Load(accessIndexPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return listCache(os.Stdout, *sortBy)
+}
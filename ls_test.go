@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListCache(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+	for filename, content := range map[string]string{
+		"big-1.0-1-x86_64.pkg.tar.xz":      testPackage + strings.Repeat("x", 1024),
+		"small-1.0-1-x86_64.pkg.tar.xz":    testPackage,
+		".partial-1.0-1-x86_64.pkg.tar.xz": "partial",
+	} {
+		if err := ioutil.WriteFile(path.Join(cacheDir, filename), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveMeta("small-1.0-1-x86_64.pkg.tar.xz", fileMeta{Repo: "extra", Arch: "x86_64"})
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(path.Join(cacheDir, "small-1.0-1-x86_64.pkg.tar.xz"), old, old)
+
+	for sortBy, first := range map[string]string{"name": "big", "size": "big", "age": "small"} {
+		var buf bytes.Buffer
+		if err := listCache(&buf, sortBy); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 4 || !strings.HasPrefix(lines[0], "SIZE") || !strings.HasSuffix(lines[3], fmt.Sprintf("2 files, %d bytes", 2*len(testPackage)+1024)) {
+			t.Fatalf("Unexpected listing sorted by %s:\n%s", sortBy, buf.String())
+		}
+		if !strings.HasSuffix(lines[1], first+"-1.0-1-x86_64.pkg.tar.xz") {
+			t.Errorf("Listing sorted by %s does not start with %s:\n%s", sortBy, first, buf.String())
+		}
+		if !strings.Contains(buf.String(), "extra  small-1.0-1-x86_64.pkg.tar.xz") {
+			t.Errorf("Repository of small package is missing:\n%s", buf.String())
+		}
+	}
+	if err := listCache(ioutil.Discard, "random"); err == nil {
+		t.Error("Invalid sort order was accepted")
+	}
+}
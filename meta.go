@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// metaDir is the directory below the cache directory holding what is known about each cached file besides its
+// content, named like the file itself.
+const metaDir = ".meta"
+
+// fileMeta is what is known about a cached file besides its content and modification time.
+type fileMeta struct {
+	ETag string `json:"etag,omitempty"`
+	Repo string `json:"repo,omitempty"`
+	Arch string `json:"arch,omitempty"`
+	Size int64  `json:"size,omitempty"`
+}
+
+func metaPath(filename string) string {
+	return path.Join(GetSettings().CacheDir, metaDir, filename)
+}
+
+// saveMeta records what is known about a cached file, replacing what was known about its previous version.
+func saveMeta(filename string, meta fileMeta) error {
+	if err := os.MkdirAll(path.Dir(metaPath(filename)), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metaPath(filename), data, 0600)
+}
+
+// loadMeta returns what is known about a cached file, nothing if it was cached by an older version.
+func loadMeta(filename string) fileMeta {
+	var meta fileMeta
+	data, err := ioutil.ReadFile(metaPath(filename))
+	if err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	return meta
+}
+
+func removeMeta(filename string) {
+	os.Remove(metaPath(filename))
+}
+
+// etagMatches reports whether the If-None-Match header lists etag, comparing weakly as required for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// mirrorlistHandler answers with a pacman mirrorlist pointing at this proxy, as reached by the client.
+func mirrorlistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	basePath := strings.Trim(GetSettings().BasePath, "/")
+	if len(basePath) > 0 {
+		basePath = "/" + basePath
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "## pkgproxy\nServer = %s://%s%s/$repo/os/$arch\n", scheme, r.Host, basePath)
+}
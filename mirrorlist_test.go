@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMirrorlistHandler(t *testing.T) {
+	tests := []struct {
+		basePath string
+		want     string
+	}{
+		{"", "## pkgproxy\nServer = http://pkgproxy.local:8080/$repo/os/$arch\n"},
+		{"/arch/", "## pkgproxy\nServer = http://pkgproxy.local:8080/arch/$repo/os/$arch\n"},
+	}
+	for _, test := range tests {
+		updateSettings(func(s *Settings) { s.BasePath = test.basePath })
+		rec := httptest.NewRecorder()
+		mirrorlistHandler(rec, httptest.NewRequest("GET", "http://pkgproxy.local:8080/mirrorlist", nil))
+		if rec.Body.String() != test.want {
+			t.Errorf("mirrorlist with base path %q was %q, want %q", test.basePath, rec.Body.String(), test.want)
+		}
+	}
+	updateSettings(func(s *Settings) { s.BasePath = "" })
+}
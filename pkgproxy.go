@@ -3,40 +3,238 @@ pkgproxy is a caching proxy server specifically designed for caching Arch GNU/Li
 
 Usage:
   pkgproxy [options]
+  pkgproxy warm -db repo.db [-arch arch] [-filter regexp] [-concurrency n] [options]
+  pkgproxy scrub [-delete] [-check-upstream] [options]
+  pkgproxy ls [-sort name|size|age] [options]
+  pkgproxy selftest [-path path] [options]
 
   Options:
+    -admin-token string
+        Bearer token granting access to the /admin/ endpoints and /stats?by=client, which are disabled if empty
+    -allow string
+        Only allow clients from these comma separated CIDR ranges, may be repeated
+    -base-path string
+        Path prefix all URLs are served below, e.g. /arch when behind a reverse proxy
     -cache string
         Cache base path (default: $XDG_CACHE_HOME)
+    -cache-db bool
+        Cache databases like packages, serving them without asking upstream for as long as -db-fresh-for, 5m unless given
+    -cache-layout string
+        Layout of the cache directory, "flat" or "nested" to store files below $repo/$arch (default "flat")
+    -config string
+        Read settings from a TOML file, flags given on the command line take precedence
+    -db-fresh-for duration
+        Serve cached databases which upstream confirmed less than this long ago without asking it again, e.g. 10m
+    -db-upstream string
+        Upstream URL used for repository databases instead of -upstream, may be repeated to fail over to further mirrors
+    -debug-headers bool
+        Add headers revealing the cache status, upstream mirror and its response time to responses
+    -dedup bool
+        Store identical packages cached for several repositories only once, using hard links
+    -deny string
+        Deny clients from these comma separated CIDR ranges unless they are allowed, may be repeated
+    -fallback-cache string
+        Read-only directory laid out like the cache, packages found there are served instead of being downloaded
+    -forward-error-body bool
+        Relay the body of upstream error responses to the client
+    -header-requests bool
+        Take repo and architecture from X-Pkgproxy-Repo and X-Pkgproxy-Arch headers if the URL lacks them
+    -instance-name string
+        Name of this instance, prefixed to every log line
     -keep-cache bool
         Keep the cache between restarts
+    -listen string
+        Listen on host:port, e.g. 127.0.0.1:8080 or [::1]:8080 for a single interface, or on a unix socket like unix:/run/pkgproxy.sock (default ":8080")
+    -lock-timeout duration
+        Answer requests waiting this long for another request of the same file with 503 and Retry-After, e.g. 30s, wait indefinitely if 0
+    -log-format string
+        Format of log lines, "text" or "json" (default "text")
+    -log-level string
+        Least important messages to log, "debug", "info", "warn" or "error" (default "info")
+    -max-age duration
+        Remove cached files which were not accessed for this long, e.g. 720h
+    -max-cache-entries int
+        Evict least recently used packages once the cache holds more files than this
+    -max-cache-size string
+        Evict least recently used packages once the cache exceeds this size, e.g. 500M or 10G
+    -max-concurrent-downloads int
+        Number of files downloaded from upstream at the same time, further downloads wait for a free slot, unlimited if 0
+    -max-file-size string
+        Refuse to download files larger than this from upstream, e.g. 2G, unlimited if 0
+    -max-inflight int
+        Answer with 503 and Retry-After while this many requests are already being handled, unlimited if 0
+    -mtime-fallback string
+        Modification time of cached files lacking a valid Last-Modified, "date" for the upstream Date header or "now" (default "date")
+    -min-size string
+        Smallest plausible size per file suffix, smaller files are not cached (default ".pkg.tar.bz2=512,.pkg.tar.gz=512,.pkg.tar.xz=512,.pkg.tar.zst=512,.sig=64")
+    -no-cache bool
+        Forward all requests to upstream without reading or writing the cache, e.g. to rule out the cache when debugging
+    -no-cache-suffixes string
+        Files with these comma separated suffixes change upstream, they are only served from the cache while upstream reports the same version (default ".db,.db.sig,.files,.files.sig")
+    -path-mode string
+        Layout of request paths, "arch" for $repo/os/$arch/$file or "generic" to cache any path below the upstream URL (default "arch")
     -port string
-        Listen on addr (default ":8080")
+        Same as -listen
+    -prefetch-sigs bool
+        Download the signature of a package into the cache as soon as the package is requested
+    -prewarm-conns int
+        Number of connections to open to each upstream mirror at startup
+    -repair bool
+        Move entries of the cache which don't fit its layout to where it keeps them or remove them instead of refusing to start with -keep-cache
+    -repos string
+        Only proxy these comma separated repositories, may be repeated
+    -revalidate bool
+        Ask upstream whether cached packages were modified before serving them
+    -server-header string
+        Value of the Server response header, omitted if empty
+    -shutdown-timeout duration
+        Time to wait for running downloads on shutdown (default 30s)
+    -stats-interval duration
+        Log the number and size of cached files about this often, e.g. 1h, disabled if 0
+    -tls-cert string
+        Serve HTTPS using the PEM encoded certificate in this file, requires -tls-key
+    -tls-key string
+        Private key matching -tls-cert
+    -trusted-proxies string
+        Take the client address from X-Forwarded-For if the request comes from these CIDR ranges
     -upstream string
-        Upstream URL (default "https://mirrors.kernel.org/archlinux/$repo/os/$arch")
+        Upstream URL, may be repeated to fail over to further mirrors (default "https://mirrors.kernel.org/archlinux/$repo/os/$arch")
+    -upstream-header string
+        Send this "Name: Value" header with every upstream request, may be repeated
+    -upstream-idle-conns int
+        Number of idle connections kept open to each upstream mirror (default 16)
+    -upstream-max-redirects int
+        Number of redirects followed for a single upstream request, 0 to treat redirects as errors (default 10)
+    -upstream-parallel int
+        Number of connections a large file is downloaded over at once if the upstream accepts ranges (default 1)
+    -upstream-pass string
+        Password sent to upstream mirrors along with -upstream-user
+    -upstream-proxy string
+        Reach upstream mirrors through this HTTP, HTTPS or SOCKS5 proxy URL instead of the one named by HTTP_PROXY and HTTPS_PROXY
+    -upstream-rate-limit string
+        Limit the bandwidth of all upstream downloads together to this many bytes per second, e.g. 5M/s
+    -upstream-retries int
+        Number of times a failing upstream mirror is retried before failing over to the next one
+    -upstream-retry-backoff duration
+        Time to wait before retrying a failing upstream mirror, doubled for every further attempt (default 1s)
+    -upstream-retry-statuses string
+        Comma separated upstream statuses which are retried, other server errors fail over to the next mirror right away (default 502,503,504)
+    -upstream-timeout duration
+        Time to wait for an upstream mirror to accept the connection and send its response headers (default 30s)
+    -upstream-user string
+        User name sent to upstream mirrors with HTTP basic authentication
+    -verify-checksums bool
+        Verify downloaded packages against the SHA256 sums in the cached repository database, sending them without a Content-Length, so clients show no progress
+    -verify-dbs bool
+        Check that repository databases can be read completely before caching or serving them
     -version bool
         Show version information
 */
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const version = "1.0.1"
 
+// maxErrorBodySize limits how much of an upstream error body is relayed to the client.
+const maxErrorBodySize = 4096
+
+// CacheMap holds the cache key of every cached repository database and its signature.
 var CacheMap = make(map[string]string)
-var MutexMap = make(map[string]*sync.Mutex)
+var CacheMapMutex sync.Mutex
+
+// cacheKeyMatches reports whether filename was cached under cacheKey, files without a key are never fresh.
+func cacheKeyMatches(filename string, cacheKey string) bool {
+	CacheMapMutex.Lock()
+	defer CacheMapMutex.Unlock()
+	return len(cacheKey) > 0 && CacheMap[filename] == cacheKey
+}
+
+func getCacheKey(filename string) string {
+	CacheMapMutex.Lock()
+	defer CacheMapMutex.Unlock()
+	return CacheMap[filename]
+}
+
+func setCacheKey(filename string, cacheKey string) {
+	CacheMapMutex.Lock()
+	defer CacheMapMutex.Unlock()
+	CacheMap[filename] = cacheKey
+}
+
+// Validators holds the conditional request headers to ask upstream whether the cached version of a repository
+// database is still current, guarded by CacheMapMutex.
+var Validators = make(map[string]http.Header)
+
+// setValidators remembers the version of filename described by the response header h.
+func setValidators(filename string, h http.Header) {
+	validators := make(http.Header)
+	if etag := h.Get("ETag"); len(etag) > 0 {
+		validators.Set("If-None-Match", etag)
+	}
+	if lastModified := h.Get("Last-Modified"); len(lastModified) > 0 {
+		validators.Set("If-Modified-Since", lastModified)
+	}
+	CacheMapMutex.Lock()
+	defer CacheMapMutex.Unlock()
+	Validators[filename] = validators
+}
+
+// conditionalHeader returns the headers to request filename only if it differs from the cached version, nil if
+// the cached version is unknown.
+func conditionalHeader(filename string) http.Header {
+	CacheMapMutex.Lock()
+	defer CacheMapMutex.Unlock()
+	validators, ok := Validators[filename]
+	if !ok || len(validators) == 0 || len(CacheMap[filename]) == 0 {
+		return nil
+	}
+	return validators
+}
+
+// ValidatedAt holds when upstream last confirmed the cached version of a repository database, guarded by CacheMapMutex.
+var ValidatedAt = make(map[string]time.Time)
+
+// forgetValidations makes every cached database be confirmed by upstream again, e.g. after switching mirrors.
+func forgetValidations() {
+	CacheMapMutex.Lock()
+	defer CacheMapMutex.Unlock()
+	ValidatedAt = make(map[string]time.Time)
+}
+
+func markValidated(filename string) {
+	CacheMapMutex.Lock()
+	defer CacheMapMutex.Unlock()
+	ValidatedAt[filename] = time.Now()
+}
+
+// validatedWithin reports whether upstream confirmed the cached version of filename less than d ago.
+func validatedWithin(filename string, d time.Duration) bool {
+	CacheMapMutex.Lock()
+	defer CacheMapMutex.Unlock()
+	t, ok := ValidatedAt[filename]
+	return ok && time.Since(t) < d
+}
 
 type Request struct {
 	Repo string
@@ -45,39 +243,150 @@ type Request struct {
 	File string
 }
 
-type Settings struct {
-	CacheDir       string
-	UpstreamServer string
-}
-
-var GSettings Settings
-
 func setupCacheDir() {
-	err := os.Mkdir(GSettings.CacheDir, 0700)
+	err := os.Mkdir(GetSettings().CacheDir, 0700)
 	if err != nil && !os.IsExist(err) {
 		panic(err)
 	}
 }
 
 func destroyCacheDir() {
-	err := os.RemoveAll(GSettings.CacheDir)
+	err := os.RemoveAll(GetSettings().CacheDir)
 	if err != nil {
 		panic(err)
 	}
 }
 
-func renameTempFile(filename *string) error {
-	return os.Rename(path.Join(GSettings.CacheDir, "."+*filename), path.Join(GSettings.CacheDir, *filename))
+// cacheName returns the name of the cache file for req, relative to the cache directory. In the flat layout, packages
+// are named with their repository and architecture prefixed, so that packages named alike in several of them don't
+// collide. Databases are kept below $repo/$arch in the flat layout as well.
+func cacheName(req *Request) string {
+	if len(req.Repo) == 0 {
+		return req.File
+	}
+	if GetSettings().CacheLayout == "nested" || isDBFile(req.File) {
+		return path.Join(req.Repo, req.Arch, req.File)
+	}
+	return flatPrefix(req.Repo, req.Arch) + req.File
+}
+
+// flatPrefix returns the prefix of packages of repo and arch in the flat layout, their path with the separators
+// encoded as %2F like for the generic path mode. Path components never contain an encoded separator themselves.
+func flatPrefix(repo string, arch string) string {
+	return repo + "%2F" + arch + "%2F"
+}
+
+// tempPath returns the path of the temp file a cache file is downloaded to.
+func tempPath(filename string) string {
+	dir, file := path.Split(filename)
+	return path.Join(GetSettings().CacheDir, dir, "."+file)
+}
+
+// createTempFile creates the temp file for filename along with the directories it is placed in.
+func createTempFile(filename string) (*os.File, error) {
+	if err := os.MkdirAll(path.Dir(tempPath(filename)), 0700); err != nil {
+		return nil, err
+	}
+	return os.Create(tempPath(filename))
+}
+
+// openCachedFile opens a cached file. Anything but a regular file is not considered to be cached, neither is an empty
+// file or one whose size differs from the size recorded when it was cached.
+func openCachedFile(filename *string) (*os.File, error) {
+	file, err := os.Open(path.Join(GetSettings().CacheDir, *filename))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a regular file", *filename)
+	}
+	if size := loadMeta(*filename).Size; fi.Size() == 0 || (size > 0 && fi.Size() != size) {
+		file.Close()
+		warnf(path.Base(*filename), "Local", "Cached file has %d bytes, expected %d, ignoring it", fi.Size(), size)
+		return nil, fmt.Errorf("%s is damaged", *filename)
+	}
+	return file, nil
+}
+
+// renameTempFile moves a completely downloaded file into the cache and sets its modification time to the upstream
+// Last-Modified, falling back according to the configured MtimeFallback if that is missing or malformed.
+func renameTempFile(filename *string, header http.Header) error {
+	err := os.Rename(tempPath(*filename), path.Join(GetSettings().CacheDir, *filename))
+	if err != nil {
+		return err
+	}
+	mtime, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil && GetSettings().MtimeFallback == "date" {
+		mtime, err = http.ParseTime(header.Get("Date"))
+	}
+	if err != nil {
+		return nil
+	}
+	return os.Chtimes(path.Join(GetSettings().CacheDir, *filename), time.Now(), mtime)
 }
 
 func removeTempFile(filename *string) error {
-	return os.Remove(path.Join(GSettings.CacheDir, "."+*filename))
+	return os.Remove(tempPath(*filename))
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
 }
 
-func buildUpstreamURL(req *Request) string {
-	upstreamURL := strings.Replace(GSettings.UpstreamServer, "$repo", req.Repo, 1)
-	upstreamURL = strings.Replace(upstreamURL, "$arch", req.Arch, 1)
-	return upstreamURL + "/" + req.File
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// sendUpstreamError replies with the status code of an unsuccessful upstream response and,
+// if enabled, the beginning of its body as plain text.
+func sendUpstreamError(w http.ResponseWriter, resp *http.Response) {
+	if GetSettings().ForwardErrorBody {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		if err == nil && len(body) > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(resp.StatusCode)
+			w.Write(body)
+			return
+		}
+	}
+	http.Error(w, http.StatusText(resp.StatusCode), resp.StatusCode)
+}
+
+// buildUpstreamURL fills in the placeholders of an upstream template, the file name is appended unless the
+// template places it with $file. With -path-mode generic, the path the file name was made of is appended instead.
+func buildUpstreamURL(upstream string, req *Request) string {
+	if GetSettings().PathMode == "generic" {
+		return strings.TrimSuffix(upstream, "/") + "/" + strings.Replace(req.File, "%2F", "/", -1)
+	}
+	upstreamURL := strings.NewReplacer("$repo", req.Repo, "$os", req.OS, "$arch", req.Arch, "$file", req.File).Replace(upstream)
+	if !strings.Contains(upstream, "$file") {
+		upstreamURL += "/" + req.File
+	}
+	return upstreamURL
+}
+
+// validPathComponent reports whether s, raw and unescaped, can safely be used as a single path component.
+func validPathComponent(s string) bool {
+	unescaped, err := url.PathUnescape(s)
+	if err != nil {
+		return false
+	}
+	for _, c := range []string{s, unescaped} {
+		if strings.ContainsAny(c, "/\\\x00") || strings.Contains(c, "..") {
+			return false
+		}
+	}
+	return true
 }
 
 func splitReqURL(requestURL string) (Request, error) {
@@ -85,15 +394,44 @@ func splitReqURL(requestURL string) (Request, error) {
 	if len(URLSplit) < 4 || len(URLSplit[3]) < 3 {
 		return Request{}, errors.New("invalid URL")
 	}
-	return Request{URLSplit[0], URLSplit[1], URLSplit[2], URLSplit[3]}, nil
+	req := Request{URLSplit[0], URLSplit[1], URLSplit[2], URLSplit[3]}
+	if !validPathComponent(req.Repo) || !validPathComponent(req.Arch) || !validPathComponent(req.File) {
+		return Request{}, errors.New("invalid path component")
+	}
+	return req, nil
 }
 
-func buildCacheKey(reqURL *string, resp *http.Response) string {
-	u, err := url.Parse(*reqURL)
-	if err != nil {
-		return ""
+// genericRequest builds a request for any path below the upstream URL, used with -path-mode generic. The path is
+// kept escaped as the file name, with its separators encoded as %2F, so it is cached as a single file.
+func genericRequest(escapedPath string) (Request, error) {
+	segments := strings.Split(strings.TrimPrefix(escapedPath, "/"), "/")
+	for _, segment := range segments {
+		if len(segment) == 0 || strings.HasPrefix(segment, ".") || !validPathComponent(segment) {
+			return Request{}, errors.New("invalid path component")
+		}
+	}
+	return Request{File: strings.Join(segments, "%2F")}, nil
+}
+
+// requestFromHeaders builds a request for clients which can't construct the usual path, taking the repo
+// and architecture from the X-Pkgproxy-Repo and X-Pkgproxy-Arch headers and the file from the last path segment.
+func requestFromHeaders(r *http.Request) (Request, error) {
+	repo := r.Header.Get("X-Pkgproxy-Repo")
+	arch := r.Header.Get("X-Pkgproxy-Arch")
+	file := path.Base(r.URL.Path)
+	if len(repo) == 0 || len(arch) == 0 || len(file) < 3 {
+		return Request{}, errors.New("invalid request headers")
+	}
+	if !validPathComponent(repo) || !validPathComponent(arch) || !validPathComponent(file) {
+		return Request{}, errors.New("invalid path component")
 	}
-	cacheKey := fmt.Sprintf("%s::", u.Hostname())
+	return Request{repo, "os", arch, file}, nil
+}
+
+// buildCacheKey describes the version of a file mirror answered with resp. It names the configured mirror rather than
+// the host it redirected to, which may change between requests, e.g. for mirrors sending clients to the nearest node.
+func buildCacheKey(mirror *Mirror, resp *http.Response) string {
+	cacheKey := fmt.Sprintf("%s::", mirror.Host())
 	if len(resp.Header.Get("ETag")) > 0 {
 		cacheKey += strings.Trim(resp.Header.Get("ETag"), "\"")
 	} else if len(resp.Header.Get("Last-Modified")) > 0 {
@@ -104,192 +442,861 @@ func buildCacheKey(reqURL *string, resp *http.Response) string {
 	return cacheKey
 }
 
+// cacheKeyHost returns the host of the mirror a cache key was built for.
+func cacheKeyHost(cacheKey string) string {
+	return strings.SplitN(cacheKey, "::", 2)[0]
+}
+
+// serveStale serves the cached version of a file which upstream failed to provide a fresh version of. It reports
+// whether a cached version existed.
+func serveStale(w http.ResponseWriter, r *http.Request, req *Request, name string) bool {
+	file, err := openCachedFile(&name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	warnf(req.File, "Upstream", "Upstream failed, serving stale cached version")
+	AccessTimes.Touch(name)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if GetSettings().DebugHeaders {
+		w.Header().Set("X-Pkgproxy-Cache-Status", "STALE")
+	}
+	if etag := loadMeta(name).ETag; len(etag) > 0 {
+		w.Header().Set("ETag", etag)
+	}
+	lastmod := time.Time{}
+	if fi, err := file.Stat(); err == nil {
+		lastmod = fi.ModTime()
+	}
+	counter := &statusRecorder{ResponseWriter: w}
+	http.ServeContent(counter, r, req.File, lastmod, file)
+	Stats.Hit(counter.bytes)
+	return true
+}
+
+// serveFallback serves a file missing from the cache from the read-only fallback cache, if it is found there.
+func serveFallback(w http.ResponseWriter, r *http.Request, req *Request, name string) bool {
+	s := GetSettings()
+	file, err := os.Open(path.Join(s.FallbackCache, name))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 {
+		return false
+	}
+	debugf(req.File, "Meta", "Serving version from the fallback cache")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if s.DebugHeaders {
+		w.Header().Set("X-Pkgproxy-Cache-Status", "FALLBACK")
+	}
+	counter := &statusRecorder{ResponseWriter: w}
+	http.ServeContent(counter, r, req.File, fi.ModTime(), file)
+	Stats.Hit(counter.bytes)
+	return true
+}
+
 func handleRequest(w http.ResponseWriter, r *http.Request, req *Request) {
 	var isCached, isDB bool
-	var fileError, respError bool
-	var resp *http.Response
+	var fileError, respError, upstreamError bool
+	var resp, dbResp *http.Response
+	var mirror, dbMirror *Mirror
 	var file *os.File
 	var err error
 	var cacheKey string
+	s := GetSettings()
+	if s.NoCache {
+		forwardUpstream(w, r.Method, req)
+		return
+	}
+	name := cacheName(req)
 
-	reqURL := buildUpstreamURL(req)
-
-	_, ok := MutexMap[req.File]
-	if !ok {
-		MutexMap[req.File] = &sync.Mutex{}
+	if !FileLocks.LockTimeout(name, s.LockTimeout) {
+		retryAfter := int((s.LockTimeout + time.Second - 1) / time.Second)
+		warnf(req.File, "Local", "Gave up waiting %s for another request of the file, sending %q", s.LockTimeout, http.StatusText(http.StatusServiceUnavailable))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
 	}
-	MutexMap[req.File].Lock()
-	defer delete(MutexMap, req.File)
+	defer FileLocks.Unlock(name)
 
-	if strings.HasSuffix(req.File, ".db") {
-		isDB = true
-		resp, err = http.Head(reqURL)
-		if err != nil {
-			log.Printf("(%s)[Upstream] Failed to query host, sending %q", req.File, http.StatusText(http.StatusInternalServerError))
+	// A download is cancelled if its client goes away while nobody else is waiting for the file.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.Context().Done():
+			if FileLocks.Users(name) == 1 {
+				cancel()
+			}
+		case <-ctx.Done():
+		}
+	}()
+
+	isDB = isDBFile(req.File)
+	fresh := isDB && s.DBFreshFor > 0 && validatedWithin(name, s.DBFreshFor)
+	if fresh {
+		debugf(req.File, "Local", "Cached version was confirmed by upstream less than %s ago", s.DBFreshFor)
+	} else if isDB {
+		// A GET is answered with the new version right away if the cached one is outdated, and only with 304 Not
+		// Modified otherwise if the cached version is known.
+		method, header := http.MethodHead, http.Header(nil)
+		if r.Method == http.MethodGet {
+			method, header = http.MethodGet, conditionalHeader(name)
+		}
+		start := time.Now()
+		resp, dbMirror, err = fetchUpstreamContext(ctx, method, req, header)
+		setUpstreamTime(w, start)
+		if (err != nil || resp.StatusCode >= http.StatusInternalServerError) && serveStale(w, r, req, name) {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return
+		} else if err != nil {
+			warnf(req.File, "Upstream", "Failed to query host, sending %q", http.StatusText(http.StatusInternalServerError))
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
-		} else if resp.StatusCode != http.StatusOK {
+		} else if resp.StatusCode != http.StatusOK && (resp.StatusCode != http.StatusNotModified || header == nil) {
 			defer resp.Body.Close()
-			log.Printf("(%s)[Upstream] Host responded with %d (%s)", req.File, resp.StatusCode, http.StatusText(resp.StatusCode))
-			http.Error(w, http.StatusText(resp.StatusCode), resp.StatusCode)
+			warnf(req.File, "Upstream", "Host responded with %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+			sendUpstreamError(w, resp)
 			return
 		}
 		defer resp.Body.Close()
-		cacheKey = buildCacheKey(&reqURL, resp)
+		if resp.StatusCode == http.StatusNotModified && dbMirror.Host() != cacheKeyHost(getCacheKey(name)) {
+			// Versions are only comparable between answers of the same mirror, another one has to send its own.
+			debugf(req.File, "Upstream", "Cached version came from another mirror")
+		} else if resp.StatusCode == http.StatusNotModified {
+			debugf(req.File, "Upstream", "Cached version is current")
+			// A 304 may leave out the validators the cached version was requested with.
+			if len(resp.Header.Get("ETag")) == 0 {
+				resp.Header.Set("ETag", header.Get("If-None-Match"))
+			}
+			if len(resp.Header.Get("Last-Modified")) == 0 {
+				resp.Header.Set("Last-Modified", header.Get("If-Modified-Since"))
+			}
+			cacheKey = getCacheKey(name)
+		} else {
+			cacheKey = buildCacheKey(dbMirror, resp)
+			if method == http.MethodGet {
+				dbResp = resp
+			}
+		}
 	}
 
-	if !isDB || (isDB && CacheMap[req.Repo] == cacheKey) {
-		file, err = os.Open(path.Join(GSettings.CacheDir, req.File))
+	if !isDB || fresh || cacheKeyMatches(name, cacheKey) {
+		file, err = openCachedFile(&name)
 		if err != nil {
-			file, err = os.Create(path.Join(GSettings.CacheDir, "."+req.File))
+			file, err = createTempFile(name)
 			if err != nil {
+				errorf(req.File, "Local", "Could not create temp file: %s", err)
 			} else {
 				defer file.Close()
 			}
 		} else {
 			defer file.Close()
 			isCached = true
+			if isDB && !fresh {
+				markValidated(name)
+			}
 		}
 	} else {
-		log.Printf("(%s)[Local] Cached version is outdated, requesting new file", req.File)
-		file, err = os.Create(path.Join(GSettings.CacheDir, "."+req.File))
+		logf(req.File, "Local", "Cached version is outdated, requesting new file")
+		file, err = createTempFile(name)
 		if err != nil {
+			errorf(req.File, "Local", "Could not create temp file: %s", err)
 		} else {
 			defer file.Close()
 		}
 	}
 
+	if isCached && !isDB && s.Revalidate {
+		if fi, err := file.Stat(); err == nil {
+			modified, err := upstreamModified(req, fi.ModTime(), loadMeta(name).ETag)
+			if err != nil {
+				warnf(req.File, "Upstream", "Could not revalidate, serving stale cached version: %s", err)
+			} else if modified {
+				logf(req.File, "Local", "Cached version is outdated, requesting new file")
+				isCached = false
+				file, err = createTempFile(name)
+				if err != nil {
+					errorf(req.File, "Local", "Could not create temp file: %s", err)
+				} else {
+					defer file.Close()
+				}
+			}
+		}
+	}
+
+	if isCached && isDB && s.VerifyDBs && isDBArchive(req.File) {
+		if err := checkCachedDB(path.Join(s.CacheDir, name)); err != nil {
+			warnf(req.File, "Local", "Cached version is damaged, requesting new file: %s", err)
+			isCached = false
+			file, err = createTempFile(name)
+			if err != nil {
+				errorf(req.File, "Local", "Could not create temp file: %s", err)
+			} else {
+				defer file.Close()
+			}
+		}
+	}
+
+	if !isCached && !isDB && len(s.FallbackCache) > 0 && serveFallback(w, r, req, name) {
+		file.Close()
+		removeTempFile(&name)
+		return
+	}
+
+	// Without a temp file, e.g. on a read-only file system, clients still get their files straight from upstream.
+	if !isCached && file == nil {
+		warnf(req.File, "Local", "Cache is not writable, forwarding without caching")
+		forwardUpstream(w, r.Method, req)
+		return
+	}
+
 	if isCached {
-		log.Printf("(%s)[Meta] Serving cached version", req.File)
+		debugf(req.File, "Meta", "Serving cached version")
+		AccessTimes.Touch(name)
 		w.Header().Set("Content-Type", "application/octet-stream")
+		if s.DebugHeaders {
+			w.Header().Set("X-Pkgproxy-Cache-Status", "HIT")
+		}
 		lastmod := time.Time{}
-		if isDB {
-			w.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
+		if fi, err := file.Stat(); err == nil {
+			lastmod = fi.ModTime()
+		}
+		if isDB && !fresh {
 			w.Header().Set("Last-Modified", resp.Header.Get("Last-Modified"))
 			w.Header().Set("ETag", resp.Header.Get("ETag"))
-			lastmod, _ = time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+			if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+				lastmod = t
+			}
+		} else if etag := loadMeta(name).ETag; len(etag) > 0 {
+			w.Header().Set("ETag", etag)
 		}
-		http.ServeContent(w, r, req.File, lastmod, file)
+		counter := &statusRecorder{ResponseWriter: w}
+		http.ServeContent(counter, r, req.File, lastmod, file)
+		Stats.Hit(counter.bytes)
+	} else if r.Method == http.MethodHead {
+		file.Close()
+		removeTempFile(&name)
+		forwardUpstream(w, http.MethodHead, req)
 	} else {
-		log.Printf("(%s)[Meta] Forwarding and saving to cache", req.File)
-		resp, err := http.Get(reqURL)
-		if err != nil {
+		logf(req.File, "Meta", "Forwarding and saving to cache")
+		Stats.Miss()
+		var size int64
+		defer func() { Stats.DownloadDone(size) }()
+		defer acquireDownloadSlot(req.File)()
+		if dbResp != nil {
+			// The database was requested along with asking whether the cached version is current.
+			resp, mirror = dbResp, dbMirror
+		} else {
+			start := time.Now()
+			resp, mirror, err = fetchUpstreamContext(ctx, http.MethodGet, req, nil)
+			setUpstreamTime(w, start)
+		}
+		if err != nil && ctx.Err() != nil {
+			file.Close()
+			removeTempFile(&name)
+			debugf(req.File, "Upstream", "Client went away, cancelled the download")
+			return
+		} else if (err != nil || resp.StatusCode >= http.StatusInternalServerError) && serveStale(w, r, req, name) {
+			if err == nil {
+				resp.Body.Close()
+			}
+			file.Close()
+			removeTempFile(&name)
+			return
+		} else if err != nil {
 			file.Close()
-			removeTempFile(&req.File)
-			log.Printf("(%s)[Upstream] Failed to query host, sending %q", req.File, http.StatusText(http.StatusInternalServerError))
+			removeTempFile(&name)
+			warnf(req.File, "Upstream", "Failed to query host, sending %q", http.StatusText(http.StatusInternalServerError))
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		} else if resp.StatusCode != http.StatusOK {
 			defer resp.Body.Close()
 			file.Close()
-			removeTempFile(&req.File)
-			log.Printf("(%s)[Upstream] Host responded with %d (%s)", req.File, resp.StatusCode, http.StatusText(resp.StatusCode))
-			http.Error(w, http.StatusText(resp.StatusCode), resp.StatusCode)
+			removeTempFile(&name)
+			warnf(req.File, "Upstream", "Host responded with %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+			sendUpstreamError(w, resp)
 			return
 		}
 		defer resp.Body.Close()
-		w.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
+		if s.MaxFileSize > 0 && resp.ContentLength > s.MaxFileSize {
+			file.Close()
+			removeTempFile(&name)
+			warnf(req.File, "Upstream", "File of %d bytes exceeds the maximum file size, sending %q", resp.ContentLength, http.StatusText(http.StatusBadGateway))
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		if s.PrefetchSigs && !isDB && !strings.HasSuffix(req.File, ".sig") {
+			go prefetchFile(Request{req.Repo, req.OS, req.Arch, req.File + ".sig"})
+		}
+		if !hasSpaceFor(resp.ContentLength) {
+			warnf(req.File, "Local", "Not enough free space for %d bytes, only forwarding", resp.ContentLength)
+			fileError = true
+		}
+		var checksum string
+		// Signatures aren't listed in the database.
+		if s.VerifyChecksums && !isDB && !strings.HasSuffix(req.File, ".sig") {
+			checksum, err = expectedChecksum(req)
+			if err != nil {
+				warnf(req.File, "Local", "Not verifying checksum: %s", err)
+			}
+		}
+		verifyDB := s.VerifyDBs && isDB && isDBArchive(req.File)
+		// Without a Content-Length the response is chunked, so aborting it on a checksum mismatch
+		// or a damaged database is noticed by the client even after all data was sent.
+		if len(checksum) == 0 && !verifyDB {
+			w.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
+		}
 		w.Header().Set("Content-Type", "application/octet-stream")
+		// Gzip is decoded by the client already, other encodings are relayed but can't be served from the cache.
+		if encoding := resp.Header.Get("Content-Encoding"); len(encoding) > 0 && encoding != "identity" {
+			logf(req.File, "Local", "Not caching response with Content-Encoding %q", encoding)
+			w.Header().Set("Content-Encoding", encoding)
+			fileError = true
+		}
 		w.Header().Set("Last-Modified", resp.Header.Get("Last-Modified"))
 		w.Header().Set("ETag", resp.Header.Get("ETag"))
+		if s.DebugHeaders {
+			w.Header().Set("X-Pkgproxy-Cache-Status", "MISS")
+			w.Header().Set("X-Pkgproxy-Upstream", mirror.Host())
+		}
+		// A client which has this version already is answered right away, the download only continues for the cache.
+		var out io.Writer = flushWriter{w}
+		if etag := resp.Header.Get("ETag"); len(etag) > 0 && etagMatches(r.Header.Get("If-None-Match"), etag) {
+			logf(req.File, "Forward", "Client has the same version, sending %q", http.StatusText(http.StatusNotModified))
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			respError = true
+		} else if start, ok := rangeStart(r, resp); ok && !fileError {
+			// A client resuming a download whose previous request was cancelled is sent the rest it asks for.
+			debugf(req.File, "Forward", "Sending the download from byte %d on", start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, resp.ContentLength-1, resp.ContentLength))
+			if len(w.Header().Get("Content-Length")) > 0 {
+				w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength-start, 10))
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			out = &skipWriter{out, start}
+		}
+		body := newUpstreamReader(resp.Body)
+		if n := chunkCount(resp, s.UpstreamParallel); n > 1 && !fileError {
+			chunked, err := newChunkedBody(ctx, resp, n)
+			if err != nil {
+				warnf(req.File, "Local", "Not downloading in parallel: %s", err)
+			} else {
+				debugf(req.File, "Upstream", "Downloading over %d connections", n)
+				defer chunked.Close()
+				body = chunked
+			}
+		}
+		head := make([]byte, 0, maxMagicSize)
+		hash := sha256.New()
 		buf := make([]byte, 4096)
 		for {
-			n, err := resp.Body.Read(buf)
-			if err != nil && err != io.EOF {
-				panic(err)
+			n, err := body.Read(buf)
+			if err != nil && err != io.EOF && resp.ContentLength >= 0 && size+int64(n) == resp.ContentLength {
+				debugf(req.File, "Upstream", "Ignoring %q after receiving the complete file", err)
+				err = io.EOF
+			}
+			if err != nil && err != io.EOF && ctx.Err() != nil {
+				debugf(req.File, "Upstream", "Client went away, cancelled the download")
+				fileError = true
+				respError = true
+			} else if err != nil && err != io.EOF {
+				warnf(req.File, "Upstream", "%s", err)
+				mirror.recordFailure()
+				upstreamError = true
+				fileError = true
+				respError = true
 			}
 			if n == 0 || (fileError && respError) {
 				break
 			}
+			// Without a Content-Length the size is only known once it is exceeded.
+			if s.MaxFileSize > 0 && size+int64(n) > s.MaxFileSize {
+				warnf(req.File, "Upstream", "File exceeds the maximum size of %d bytes, aborting the response", s.MaxFileSize)
+				file.Close()
+				removeTempFile(&name)
+				panic(http.ErrAbortHandler)
+			}
+			if missing := maxMagicSize - len(head); missing > 0 {
+				if missing > n {
+					missing = n
+				}
+				head = append(head, buf[:missing]...)
+			}
+			size += int64(n)
+			if len(checksum) > 0 || s.Dedup {
+				hash.Write(buf[:n])
+			}
 			if !fileError {
 				if _, err := file.Write(buf[:n]); err != nil {
-					log.Printf("(%s)[Local] %s", req.File, err)
+					errorf(req.File, "Local", "%s", err)
 					fileError = true
 				}
 			}
 			if !respError {
-				if _, err := w.Write(buf[:n]); err != nil {
-					log.Printf("(%s)[Forward] %s", req.File, err)
+				if _, err := out.Write(buf[:n]); err != nil {
+					warnf(req.File, "Forward", "%s", err)
 					respError = true
 				}
 			}
 		}
 
 		if !fileError {
-			err = renameTempFile(&req.File)
+			if err := checkPlausible(req.File, size, head); err != nil {
+				warnf(req.File, "Local", "Refusing to cache: %s", err)
+				fileError = true
+			}
+		}
+		if !fileError && len(checksum) > 0 && hex.EncodeToString(hash.Sum(nil)) != checksum {
+			errorf(req.File, "Local", "Checksum mismatch, aborting the response")
+			mirror.recordFailure()
+			file.Close()
+			removeTempFile(&name)
+			panic(http.ErrAbortHandler)
+		}
+		if !fileError && verifyDB {
+			if err := checkDB(tempPath(name)); err != nil {
+				errorf(req.File, "Local", "Database is damaged, aborting the response: %s", err)
+				mirror.recordFailure()
+				file.Close()
+				removeTempFile(&name)
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if !fileError {
+			file.Close()
+			err = renameTempFile(&name, resp.Header)
 			if err != nil {
-				log.Printf("(%s)[Local] Could not rename temp file", req.File)
+				removeTempFile(&name)
+				errorf(req.File, "Local", "Could not rename temp file: %s", err)
 			} else {
-				log.Printf("(%s)[Local] Successfully cached", req.File)
-			}
-			if isDB {
-				CacheMap[req.Repo] = cacheKey
+				logf(req.File, "Local", "Successfully cached")
+				if err := saveMeta(name, fileMeta{ETag: resp.Header.Get("ETag"), Repo: req.Repo, Arch: req.Arch, Size: size}); err != nil {
+					errorf(req.File, "Local", "Could not save metadata: %s", err)
+				}
+				if isDB {
+					// The downloaded version is the one to compare against, whatever upstream announced before.
+					setCacheKey(name, buildCacheKey(mirror, resp))
+					setValidators(name, resp.Header)
+					markValidated(name)
+				} else if s.Dedup {
+					if err := dedupFile(name, hex.EncodeToString(hash.Sum(nil))); err != nil {
+						errorf(req.File, "Local", "Could not deduplicate: %s", err)
+					}
+				}
+				AccessTimes.Touch(name)
+				enforceCacheLimits()
 			}
 		} else {
 			file.Close()
-			removeTempFile(&req.File)
-			log.Printf("(%s)[Local] Could not cache", req.File)
+			removeTempFile(&name)
+			warnf(req.File, "Local", "Could not cache")
 		}
 		if !respError {
-			log.Printf("(%s)[Forward] Successfully forwarded", req.File)
+			logf(req.File, "Forward", "Successfully forwarded")
 		} else {
-			log.Printf("(%s)[Forward] Error while forwarding", req.File)
+			warnf(req.File, "Forward", "Error while forwarding")
+		}
+		if upstreamError {
+			// Returning normally would end a chunked response as if the file was complete.
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// setUpstreamTime reveals with -debug-headers how long upstream took to answer a request made at start,
+// telling a slow mirror apart from a slow client.
+func setUpstreamTime(w http.ResponseWriter, start time.Time) {
+	if GetSettings().DebugHeaders {
+		w.Header().Set("X-Pkgproxy-Upstream-Time", fmt.Sprintf("%.1fms", time.Since(start).Seconds()*1000))
+	}
+}
+
+// forwardUpstream relays the upstream response to a GET or HEAD request without touching the cache.
+func forwardUpstream(w http.ResponseWriter, method string, req *Request) {
+	logf(req.File, "Meta", "Forwarding %s request without caching", method)
+	start := time.Now()
+	resp, mirror, err := fetchUpstream(method, req)
+	setUpstreamTime(w, start)
+	if err != nil {
+		warnf(req.File, "Upstream", "Failed to query host, sending %q", http.StatusText(http.StatusInternalServerError))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		warnf(req.File, "Upstream", "Host responded with %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+		sendUpstreamError(w, resp)
+		return
+	}
+	for _, header := range []string{"Content-Length", "Content-Encoding", "Last-Modified", "ETag"} {
+		if value := resp.Header.Get(header); len(value) > 0 {
+			w.Header().Set(header, value)
 		}
 	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if GetSettings().DebugHeaders {
+		w.Header().Set("X-Pkgproxy-Cache-Status", "MISS")
+		w.Header().Set("X-Pkgproxy-Upstream", mirror.Host())
+	}
+	w.WriteHeader(http.StatusOK)
+	if method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(flushWriter{w}, newUpstreamReader(resp.Body)); err != nil {
+		warnf(req.File, "Forward", "%s", err)
+		// Returning normally would end a chunked response as if the file was complete.
+		panic(http.ErrAbortHandler)
+	}
+	logf(req.File, "Forward", "Successfully forwarded")
+}
+
+// rangeStart returns the offset an open ended Range asks for, like the one of a resumed download, if it is satisfiable
+// from the file answered with resp. Other ranges are answered with the complete file.
+func rangeStart(r *http.Request, resp *http.Response) (int64, bool) {
+	spec := r.Header.Get("Range")
+	if !strings.HasPrefix(spec, "bytes=") || !strings.HasSuffix(spec, "-") || resp.ContentLength < 0 {
+		return 0, false
+	}
+	if ifRange := r.Header.Get("If-Range"); len(ifRange) > 0 && ifRange != resp.Header.Get("ETag") && ifRange != resp.Header.Get("Last-Modified") {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(spec, "bytes="), "-"), 10, 64)
+	if err != nil || start < 0 || start >= resp.ContentLength {
+		return 0, false
+	}
+	return start, true
+}
+
+// skipWriter drops the first skip bytes written to it and passes the rest on to w.
+type skipWriter struct {
+	w    io.Writer
+	skip int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	if s.skip >= int64(len(p)) {
+		s.skip -= int64(len(p))
+		return len(p), nil
+	}
+	n, err := s.w.Write(p[s.skip:])
+	n += int(s.skip)
+	s.skip = 0
+	return n, err
+}
+
+// flushWriter flushes the response after every write, so that streamed data reaches the client right away instead
+// of piling up in buffers, e.g. those of HTTP/2 or of a reverse proxy.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// discardWriter is a ResponseWriter throwing away the response, used for downloads no client is waiting for.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardWriter) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
+
+// prefetchFile downloads a file into the cache unless it is cached already. Clients requesting the file
+// in the meantime wait for the download to finish and are then served from the cache.
+func prefetchFile(req Request) error {
+	if _, err := os.Stat(path.Join(GetSettings().CacheDir, cacheName(&req))); err == nil {
+		return nil
+	}
+	debugf(req.File, "Meta", "Prefetching")
+	err := fetchFile(req)
+	if err != nil {
+		warnf(req.File, "Meta", "Prefetching failed: %s", err)
+	}
+	return err
+}
+
+// fetchFile passes a GET request for req through handleRequest with no client waiting for the response, so that
+// the file is revalidated and downloaded like for any client. It reports whether the file could be served.
+func fetchFile(req Request) (err error) {
+	r, err := http.NewRequest(http.MethodGet, "/"+path.Join(req.Repo, req.OS, req.Arch, req.File), nil)
+	if err != nil {
+		return err
+	}
+	w := &discardWriter{header: make(http.Header)}
+	// Outside of a request, nothing else recovers from a download aborted by handleRequest.
+	defer func() {
+		if p := recover(); p == http.ErrAbortHandler {
+			err = errors.New("download was aborted")
+		} else if p != nil {
+			panic(p)
+		}
+	}()
+	handleRequest(w, r, &req)
+	if w.status >= http.StatusBadRequest {
+		return fmt.Errorf("answered with %d (%s)", w.status, http.StatusText(w.status))
+	}
+	return nil
+}
+
+// stripBasePath removes the base path from the start of urlPath, reporting whether urlPath is below it.
+func stripBasePath(urlPath string, basePath string) (string, bool) {
+	basePath = strings.Trim(basePath, "/")
+	if len(basePath) == 0 {
+		return urlPath, true
+	}
+	basePath = "/" + basePath
+	if urlPath == basePath {
+		return "/", true
+	}
+	if !strings.HasPrefix(urlPath, basePath+"/") {
+		return urlPath, false
+	}
+	return urlPath[len(basePath):], true
+}
+
+// withBasePath serves h below the configured base path, requests for anything else are answered with 404.
+func withBasePath(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		basePath := GetSettings().BasePath
+		if len(strings.Trim(basePath, "/")) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		urlPath, ok := stripBasePath(r.URL.Path, basePath)
+		if !ok {
+			debugf("", "Incoming", "URL %s is outside of the base path, sending %q", r.URL, http.StatusText(http.StatusNotFound))
+			http.NotFound(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path = urlPath
+		if len(r.URL.RawPath) > 0 {
+			if u.RawPath, ok = stripBasePath(r.URL.RawPath, basePath); !ok {
+				u.RawPath = ""
+			}
+		}
+		r2 := *r
+		r2.URL = &u
+		h.ServeHTTP(w, &r2)
+	})
+}
+
+// withServerHeader sets the configured Server header on all responses of h.
+func withServerHeader(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if serverHeader := GetSettings().ServerHeader; len(serverHeader) > 0 {
+			w.Header().Set("Server", serverHeader)
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[Incoming] Request for URL: %s\n", r.URL)
+	defer Stats.End()
+	if inFlight, max := Stats.Begin(), GetSettings().MaxInflight; max > 0 && inFlight > int64(max) {
+		warnf("", "Incoming", "%d requests in flight, sending %q", inFlight-1, http.StatusText(http.StatusServiceUnavailable))
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
 
-	if r.Method != "GET" {
-		log.Printf("[Incoming] We don't do %q, sending %q", r.Method, http.StatusText(http.StatusNotImplemented))
+	if host := r.Header.Get("X-Forwarded-Host"); len(host) > 0 {
+		debugf("", "Incoming", "Request for URL: %s (forwarded for %s)", r.URL, host)
+	} else {
+		debugf("", "Incoming", "Request for URL: %s", r.URL)
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		debugf("", "Incoming", "We don't do %q, sending %q", r.Method, http.StatusText(http.StatusNotImplemented))
 		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
 		return
 	}
 
-	req, err := splitReqURL(r.URL.String())
+	var req Request
+	var err error
+	if GetSettings().PathMode == "generic" {
+		req, err = genericRequest(r.URL.EscapedPath())
+	} else {
+		req, err = splitReqURL(r.URL.String())
+		if err != nil && GetSettings().HeaderRequests {
+			req, err = requestFromHeaders(r)
+		}
+	}
 	if err != nil {
-		log.Printf("[Incoming] URL invalid, sending %q", http.StatusText(http.StatusBadRequest))
+		debugf("", "Incoming", "URL invalid, sending %q", http.StatusText(http.StatusBadRequest))
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	handleRequest(w, r, &req)
+	if !GetSettings().Repos.allows(req.Repo) {
+		warnf(req.File, "Incoming", "Repository %q is not proxied, sending %q", req.Repo, http.StatusText(http.StatusForbidden))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	Stats.Request()
+	rec := &statusRecorder{ResponseWriter: w}
+	defer logRequest(req.File, rec, time.Now())
+	defer func() { ClientStats.Served(clientName(r), rec.bytes) }()
+	handleRequest(rec, r, &req)
 }
 
 func main() {
-	flCachePath := flag.String("cache", "", "Cache base path")
-	flAddr := flag.String("port", ":8080", "Listen on addr")
-	flUpstream := flag.String("upstream", "https://mirrors.kernel.org/archlinux/$repo/os/$arch", "Upstream URL")
-	flShowVersion := flag.Bool("version", false, "Show version information")
-	flKeepCache := flag.Bool("keep-cache", false, "Keep the cache between restarts")
-	flag.Parse()
-
-	if *flShowVersion {
+	if len(os.Args) > 1 && os.Args[1] == "warm" {
+		if err := runWarm(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scrub" {
+		if err := runScrub(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ls" {
+		if err := runLs(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		if err := runSelfTest(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	s, err := parseSettings(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if s.ShowVersion {
 		fmt.Printf("pkgproxy %s\n", version)
 		return
 	}
 
-	if len(*flCachePath) > 0 {
-		GSettings.CacheDir = *flCachePath
-	} else {
-		var err error
-		GSettings.CacheDir, err = os.UserCacheDir()
-		if err != nil {
-			panic(err)
-		}
+	s.Mirrors = newMirrors(s.UpstreamServers)
+	s.DBMirrors = newMirrors(s.DBUpstreams)
+	SetSettings(s)
+	if s.LogFormat == "json" {
+		log.SetFlags(0)
+	} else if len(s.InstanceName) > 0 {
+		log.SetPrefix(s.InstanceName + " ")
 	}
-	GSettings.CacheDir = path.Join(GSettings.CacheDir, "pkgproxy")
-	GSettings.UpstreamServer = *flUpstream
 
-	if *flKeepCache {
+	if err := checkCacheDir(); err != nil {
+		log.Fatal(err)
+	}
+	if s.KeepCache {
 		setupCacheDir()
+		misplaced, err := misplacedFiles()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(misplaced) > 0 && !s.Repair {
+			log.Fatalf("%d entries in the cache don't fit the %s layout, e.g. %s, start once with -repair to move or remove them", len(misplaced), s.CacheLayout, misplaced[0])
+		} else if err := repairCache(misplaced); err != nil {
+			log.Fatal(err)
+		}
+		// Temp files left behind by a crash are incomplete and can't be resumed.
+		removeTempFiles()
+		if err := AccessTimes.Load(accessIndexPath()); err != nil && !os.IsNotExist(err) {
+			errorf("", "Local", "Could not load access times: %s", err)
+		}
+		go runAccessIndex()
 	} else {
 		destroyCacheDir()
 		setupCacheDir()
 		defer destroyCacheDir()
 	}
 
+	idleConns := s.UpstreamConns
+	if idleConns < s.PrewarmConns {
+		idleConns = s.PrewarmConns
+	}
+	UpstreamClient = newUpstreamClient(s.UpstreamTimeout, idleConns, s.ProxyURL)
+	if s.MaxDownloads > 0 {
+		DownloadSlots = make(chan struct{}, s.MaxDownloads)
+	}
+	go runJanitor()
+	go runReadinessChecks()
+	go runStatsLog()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		notifyStatsSignal(sigs)
+		for range sigs {
+			logStats()
+		}
+	}()
+	if s.PrewarmConns > 0 {
+		go prewarmConnections(s.PrewarmConns)
+	}
+
 	http.HandleFunc("/", handler)
-	log.Fatal(http.ListenAndServe(*flAddr, nil))
+	http.HandleFunc("/admin/reload", adminReloadHandler)
+	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/mirrorlist", mirrorlistHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	server := &http.Server{Addr: s.ListenAddr, Handler: withServerHeader(withAccessControl(withBasePath(http.DefaultServeMux)))}
+
+	stopped := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		logf("", "Shutdown", "Received %s, waiting up to %s for running downloads", sig, s.ShutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			errorf("", "Shutdown", "%s", err)
+		}
+		close(stopped)
+	}()
+
+	listener, err := listen(s.ListenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(s.TLSCert) > 0 {
+		err = server.ServeTLS(listener, s.TLSCert, s.TLSKey)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	removeTempFiles()
+	if s.KeepCache {
+		if err := AccessTimes.Save(accessIndexPath()); err != nil {
+			errorf("", "Local", "Could not save access times: %s", err)
+		}
+	}
 }
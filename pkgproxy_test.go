@@ -1,18 +1,75 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPackage is the content of a tiny xz compressed package.
+const testPackage = "\xfd7zXZ\x00package"
+
+// notModified answers a request for the version etag with 304 Not Modified if the client has it already.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") != etag {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// updateSettings applies update to a copy of the settings in effect.
+func updateSettings(update func(s *Settings)) {
+	s := *GetSettings()
+	update(&s)
+	SetSettings(&s)
+}
+
+// setupTestCache points the cache at a fresh temporary directory and the mirror list at the given upstream servers.
+func setupTestCache(t testing.TB, upstreams ...string) string {
+	cacheDir, err := ioutil.TempDir("", "pkgproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range upstreams {
+		upstreams[i] += "/$repo/os/$arch"
+	}
+	SetSettings(&Settings{CacheDir: cacheDir, Mirrors: newMirrors(upstreams), NoCacheSuffixes: suffixList{".db", ".db.sig", ".files", ".files.sig"}})
+	CacheMap = make(map[string]string)
+	ValidatedAt = make(map[string]time.Time)
+	Validators = make(map[string]http.Header)
+	return cacheDir
+}
 
 func TestBuildUpstreamURL(t *testing.T) {
-	GSettings.UpstreamServer = "https://example.org/pub/archlinux/$repo/os/$arch"
+	upstream := "https://example.org/pub/archlinux/$repo/os/$arch"
 
 	req := Request{"extra", "os", "x86_64", "extra.db"}
-	url := buildUpstreamURL(&req)
+	url := buildUpstreamURL(upstream, &req)
 	if url != "https://example.org/pub/archlinux/extra/os/x86_64/extra.db" {
 		t.Error("URL does not match")
 	}
 
+	url = buildUpstreamURL("https://example.org/$arch/$repo/pool/$file?os=$os", &req)
+	if url != "https://example.org/x86_64/extra/pool/extra.db?os=os" {
+		t.Errorf("URL %s does not match", url)
+	}
+
 	req = Request{}
-	url = buildUpstreamURL(&req)
+	url = buildUpstreamURL(upstream, &req)
 	if url != "https://example.org/pub/archlinux//os//" {
 		t.Error("URL does not match")
 	}
@@ -31,3 +88,1410 @@ func TestSplitReqURL(t *testing.T) {
 		t.Error("Parsing URL should have failed")
 	}
 }
+
+func TestHandleRequestEvictedFile(t *testing.T) {
+	var hits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	req := httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+	handler(httptest.NewRecorder(), req)
+	if err := os.Remove(path.Join(cacheDir, "extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz")); err != nil {
+		t.Fatal("File was not cached")
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+		t.Error("Evicted file was not fetched again")
+	}
+	if hits != 2 {
+		t.Error("Evicted file should have been requested from upstream")
+	}
+}
+
+func TestHandleRequestDamagedFile(t *testing.T) {
+	var hits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	req := httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+	if err := ioutil.WriteFile(path.Join(cacheDir, "extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if hits != 1 || rec.Body.String() != testPackage {
+		t.Error("Empty cached file was served")
+	}
+
+	if err := ioutil.WriteFile(path.Join(cacheDir, "extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz"), []byte(testPackage[:10]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if hits != 2 || rec.Body.String() != testPackage {
+		t.Error("Cached file of the wrong size was served")
+	}
+}
+
+func TestForwardErrorBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "mirror syncing", http.StatusNotFound)
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+
+	req := httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), "mirror syncing") {
+		t.Error("Upstream error body should not be forwarded by default")
+	}
+
+	updateSettings(func(s *Settings) { s.ForwardErrorBody = true })
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "mirror syncing") {
+		t.Error("Upstream error body was not forwarded")
+	}
+}
+
+func TestHandleRequestRenameFailure(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	filename := "extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz"
+	if err := os.MkdirAll(path.Join(cacheDir, filename, "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+		t.Error("File should be forwarded even if it can not be cached")
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "."+filename)); !os.IsNotExist(err) {
+		t.Error("Temp file was not removed after failed rename")
+	}
+}
+
+func TestWithServerHeader(t *testing.T) {
+	h := withServerHeader(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer SetSettings(GetSettings())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Header().Get("Server") != "" {
+		t.Error("Server header should be omitted by default")
+	}
+
+	updateSettings(func(s *Settings) { s.ServerHeader = "pkgproxy" })
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Header().Get("Server") != "pkgproxy" {
+		t.Error("Server header does not match")
+	}
+}
+
+// disconnectingWriter is a ResponseWriter whose client goes away once it received limit bytes, which is noticed by
+// cancelling the request context unless cancel is nil.
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	limit  int
+	cancel context.CancelFunc
+}
+
+func (w *disconnectingWriter) Write(p []byte) (int, error) {
+	if w.Body.Len()+len(p) >= w.limit {
+		n, _ := w.ResponseRecorder.Write(p[:w.limit-w.Body.Len()])
+		if w.cancel != nil {
+			w.cancel()
+		}
+		return n, errors.New("client disconnected")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestResumeAfterDisconnect(t *testing.T) {
+	content := testPackage + strings.Repeat("x", 64*1024)
+	half := len(content) / 2
+	var sent chan struct{}
+	var release chan struct{}
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write([]byte(content[:half]))
+		w.(http.Flusher).Flush()
+		sent <- struct{}{}
+		select {
+		case <-release:
+			w.Write([]byte(content[half:]))
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	resume := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", half))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	complete := func(filename string) bool {
+		cached, err := ioutil.ReadFile(path.Join(cacheDir, filename))
+		return err == nil && string(cached) == content
+	}
+
+	for _, stillDownloading := range []bool{true, false} {
+		filename := fmt.Sprintf("foo-%t-1.0-1-x86_64.pkg.tar.xz", stillDownloading)
+		url := "/extra/os/x86_64/" + filename
+		name := "extra%2Fx86_64%2F" + filename
+		sent, release = make(chan struct{}, 2), make(chan struct{})
+		atomic.StoreInt32(&requests, 0)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		first := &disconnectingWriter{httptest.NewRecorder(), half, cancel}
+		if !stillDownloading {
+			// The download completes before the client going away is noticed.
+			first.cancel = nil
+			close(release)
+		}
+		handler(first, httptest.NewRequest("GET", url, nil).WithContext(ctx))
+		cancel()
+		if first.Body.String() != content[:half] {
+			t.Error("First client did not receive the first half")
+		}
+
+		var rec *httptest.ResponseRecorder
+		if stillDownloading {
+			// The first client was the only one, so its download was cancelled and the resumed request downloads the
+			// file again, being served its range while the download is still running.
+			if complete(name) {
+				t.Error("Download was completed although its only client went away")
+			}
+			resumed := make(chan *httptest.ResponseRecorder)
+			go func() { resumed <- resume(url) }()
+			<-sent
+			if complete(name) {
+				t.Error("File was complete before the resumed download finished")
+			}
+			close(release)
+			rec = <-resumed
+		} else {
+			if !complete(name) {
+				t.Error("File was not complete when the resumed request arrived")
+			}
+			rec = resume(url)
+		}
+
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != content[half:] {
+			t.Errorf("Resumed download failed with %d (still downloading: %t)", rec.Code, stillDownloading)
+		}
+		if !complete(name) {
+			t.Errorf("File was not cached completely after resuming (still downloading: %t)", stillDownloading)
+		}
+		if expected := map[bool]int32{true: 2, false: 1}[stillDownloading]; atomic.LoadInt32(&requests) != expected {
+			t.Errorf("Upstream was requested %d times, expected %d (still downloading: %t)", requests, expected, stillDownloading)
+		}
+	}
+}
+
+func TestHandleRequestClientGone(t *testing.T) {
+	content := testPackage + strings.Repeat("x", 64*1024)
+	var started, release, upstreamCancelled chan struct{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write([]byte(content[:len(content)/2]))
+		w.(http.Flusher).Flush()
+		close(started)
+		select {
+		case <-release:
+			w.Write([]byte(content[len(content)/2:]))
+		case <-r.Context().Done():
+			close(upstreamCancelled)
+		}
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	for _, othersWaiting := range []bool{false, true} {
+		filename := fmt.Sprintf("foo-%t-1.0-1-x86_64.pkg.tar.xz", othersWaiting)
+		name := "extra%2Fx86_64%2F" + filename
+		started, release, upstreamCancelled = make(chan struct{}), make(chan struct{}), make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/"+filename, nil).WithContext(ctx))
+			close(done)
+		}()
+		<-started
+		waiter := make(chan struct{})
+		if othersWaiting {
+			go func() {
+				FileLocks.Lock(name)
+				FileLocks.Unlock(name)
+				close(waiter)
+			}()
+			for FileLocks.Users(name) < 2 {
+				time.Sleep(time.Millisecond)
+			}
+		} else {
+			close(waiter)
+		}
+		cancel()
+
+		if othersWaiting {
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+		} else {
+			select {
+			case <-upstreamCancelled:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Upstream download was not cancelled")
+			}
+		}
+		<-done
+		<-waiter
+		if _, err := os.Stat(path.Join(cacheDir, name)); (err == nil) != othersWaiting {
+			t.Errorf("Download with others waiting = %t was cached = %t", othersWaiting, err == nil)
+		}
+		if _, err := os.Stat(tempPath(name)); !os.IsNotExist(err) {
+			t.Error("Temp file was left behind")
+		}
+	}
+}
+
+func TestRequestFromHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/downloads/abiword-3.0.2-9-x86_64.pkg.tar.xz", nil)
+	r.Header.Set("X-Pkgproxy-Repo", "extra")
+	r.Header.Set("X-Pkgproxy-Arch", "x86_64")
+	req, err := requestFromHeaders(r)
+	if err != nil {
+		t.Error("Building request from headers failed")
+	} else if req.Repo != "extra" || req.OS != "os" || req.Arch != "x86_64" || req.File != "abiword-3.0.2-9-x86_64.pkg.tar.xz" {
+		t.Error("Request built from headers does not match expected result")
+	}
+
+	r.Header.Del("X-Pkgproxy-Arch")
+	if _, err := requestFromHeaders(r); err == nil {
+		t.Error("Building request without arch header should have failed")
+	}
+}
+
+func TestHandlerHeaderRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+
+	r := httptest.NewRequest("GET", "/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+	r.Header.Set("X-Pkgproxy-Repo", "extra")
+	r.Header.Set("X-Pkgproxy-Arch", "x86_64")
+
+	rec := httptest.NewRecorder()
+	handler(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Error("Headers should be ignored unless enabled")
+	}
+
+	updateSettings(func(s *Settings) { s.HeaderRequests = true })
+	rec = httptest.NewRecorder()
+	handler(rec, r)
+	if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+		t.Error("Request built from headers was not served")
+	}
+}
+
+func TestHandleRequestAbruptClose(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(testPackage), testPackage)
+		buf.Flush()
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		conn.Close()
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+		t.Error("Complete file was not forwarded")
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz")); err != nil {
+		t.Error("Complete file was not cached")
+	}
+}
+
+func TestRenameTempFileModTime(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+
+	lastModified := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	date := time.Date(2019, 10, 2, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		fallback     string
+		lastModified string
+		expected     time.Time
+	}{
+		{"date", lastModified.Format(http.TimeFormat), lastModified},
+		{"date", lastModified.Format(time.RFC850), lastModified},
+		{"date", "", date},
+		{"date", "yesterday", date},
+		{"now", "", time.Time{}},
+		{"now", "yesterday", time.Time{}},
+	} {
+		updateSettings(func(s *Settings) { s.MtimeFallback = tc.fallback })
+		filename := "foo-1.0-1-x86_64.pkg.tar.xz"
+		if err := ioutil.WriteFile(path.Join(cacheDir, "."+filename), []byte(testPackage), 0600); err != nil {
+			t.Fatal(err)
+		}
+		header := http.Header{"Date": {date.Format(http.TimeFormat)}}
+		if len(tc.lastModified) > 0 {
+			header.Set("Last-Modified", tc.lastModified)
+		}
+		if err := renameTempFile(&filename, header); err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := os.Stat(path.Join(cacheDir, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.expected.IsZero() {
+			if time.Since(fi.ModTime()) > time.Minute {
+				t.Errorf("Modification time should be now with Last-Modified %q", tc.lastModified)
+			}
+		} else if !fi.ModTime().Equal(tc.expected) {
+			t.Errorf("Modification time does not match with Last-Modified %q", tc.lastModified)
+		}
+	}
+}
+
+func TestHandleRequestMultipleRanges(t *testing.T) {
+	content := testPackage + strings.Repeat("x", 1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", "\"1\"")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+
+	for _, filename := range []string{"foo-1.0-1-x86_64.pkg.tar.xz", "extra.db"} {
+		req := httptest.NewRequest("GET", "/extra/os/x86_64/"+filename, nil)
+		req.Header.Set("Range", "bytes=0-5,10-20")
+
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != content {
+			t.Errorf("Uncached %s should be forwarded completely", filename)
+		}
+
+		rec = httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusPartialContent || !strings.HasPrefix(rec.Header().Get("Content-Type"), "multipart/byteranges") {
+			t.Errorf("Cached %s was not served as multiple ranges", filename)
+		}
+		if contentLength := rec.Header().Get("Content-Length"); contentLength != "" && contentLength != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("Content-Length of cached %s does not match body", filename)
+		}
+		if !strings.Contains(rec.Body.String(), content[0:6]) || !strings.Contains(rec.Body.String(), content[10:21]) {
+			t.Errorf("Ranges of cached %s are missing", filename)
+		}
+	}
+}
+
+func TestHandleRequestIfRange(t *testing.T) {
+	content := testPackage + strings.Repeat("x", 1024)
+	lastModified := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"1"`)
+		http.ServeContent(w, r, "", lastModified, strings.NewReader(content))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+
+	for _, filename := range []string{"foo-1.0-1-x86_64.pkg.tar.xz", "extra.db"} {
+		url := "/extra/os/x86_64/" + filename
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+
+		for ifRange, partial := range map[string]bool{
+			`"1"`:                                true,
+			`"2"`:                                false,
+			lastModified.Format(http.TimeFormat): true,
+			lastModified.Add(-time.Hour).Format(http.TimeFormat): false,
+		} {
+			req := httptest.NewRequest("GET", url, nil)
+			req.Header.Set("Range", "bytes=10-")
+			req.Header.Set("If-Range", ifRange)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if partial && (rec.Code != http.StatusPartialContent || rec.Body.String() != content[10:]) {
+				t.Errorf("Cached %s with matching If-Range %s returned %d, expected the range", filename, ifRange, rec.Code)
+			}
+			if !partial && (rec.Code != http.StatusOK || rec.Body.String() != content) {
+				t.Errorf("Cached %s with outdated If-Range %s returned %d, expected the whole file", filename, ifRange, rec.Code)
+			}
+		}
+	}
+}
+
+func TestSplitReqURLTraversal(t *testing.T) {
+	for _, requestURL := range []string{
+		"/extra/os/x86_64/..",
+		"/extra/os/x86_64/..%2f..%2fetc%2fpasswd",
+		"/extra/os/x86_64/%2e%2e%2fpasswd",
+		"/extra/os/x86_64/..%5c..%5cpasswd",
+		"/extra/os/x86_64/foo%00.pkg.tar.xz",
+		"/../os/x86_64/foo.pkg.tar.xz",
+		"/extra/os/..%2f..%2f/foo.pkg.tar.xz",
+	} {
+		if _, err := splitReqURL(requestURL); err == nil {
+			t.Errorf("Parsing %q should have failed", requestURL)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/..%2f..%2fetc%2fpasswd", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Error("Path traversal should be rejected with 400")
+	}
+}
+
+func TestHandleRequestRevalidate(t *testing.T) {
+	var gets int
+	lastmod := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		w.Header().Set("Last-Modified", lastmod.Format(http.TimeFormat))
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.Revalidate = true })
+
+	req := httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+	handler(httptest.NewRecorder(), req)
+	handler(httptest.NewRecorder(), req)
+	if gets != 1 {
+		t.Errorf("Unmodified file was downloaded %d times, expected once", gets)
+	}
+
+	lastmod = lastmod.Add(time.Hour)
+	handler(httptest.NewRecorder(), req)
+	if gets != 2 {
+		t.Error("Modified file was not downloaded again")
+	}
+	fi, err := os.Stat(path.Join(cacheDir, "extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz"))
+	if err != nil || !fi.ModTime().Equal(lastmod) {
+		t.Error("Cached file was not replaced by the modified version")
+	}
+
+	upstream.Close()
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+		t.Error("Cached file was not served while upstream is unreachable")
+	}
+}
+
+func TestHandleRequestRevalidateETag(t *testing.T) {
+	var gets int
+	etag := `"1"`
+	lastmod := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		if len(etag) > 0 {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Last-Modified", lastmod.Format(http.TimeFormat))
+		}
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+	updateSettings(func(s *Settings) { s.Revalidate = true })
+
+	req := httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+	handler(httptest.NewRecorder(), req)
+	handler(httptest.NewRecorder(), req)
+	if gets != 1 {
+		t.Errorf("Unmodified file was downloaded %d times, expected once", gets)
+	}
+
+	etag = `"2"`
+	handler(httptest.NewRecorder(), req)
+	if gets != 2 {
+		t.Error("File whose ETag changed was not downloaded again")
+	}
+
+	etag = ""
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if gets != 2 || rec.Body.String() != testPackage {
+		t.Error("Cached file was not served while upstream sent no validators")
+	}
+}
+
+func TestHandleRequestStaleIfError(t *testing.T) {
+	var failing bool
+	lastmod := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing && (r.Method == http.MethodGet || path.Ext(r.URL.Path) == ".db") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Last-Modified", lastmod.Format(http.TimeFormat))
+		if path.Ext(r.URL.Path) == ".db" {
+			w.Write([]byte("\x89database"))
+		} else {
+			w.Write([]byte(testPackage))
+		}
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+	updateSettings(func(s *Settings) { s.Revalidate = true })
+
+	for _, filename := range []string{"extra.db", "foo-1.0-1-x86_64.pkg.tar.xz"} {
+		req := httptest.NewRequest("GET", "/extra/os/x86_64/"+filename, nil)
+		handler(httptest.NewRecorder(), req)
+		failing = true
+		lastmod = lastmod.Add(time.Hour)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Errorf("Stale %s was not served while upstream fails, got %d", filename, rec.Code)
+		}
+		failing = false
+	}
+
+	failing = true
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/bar-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Uncached file returned %d while upstream fails, expected 503", rec.Code)
+	}
+}
+
+func TestHandleRequestETag(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", "\"abc\"")
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+
+	req := httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+	handler(httptest.NewRecorder(), req)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Header().Get("ETag") != "\"abc\"" {
+		t.Errorf("Cached file was served with ETag %q", rec.Header().Get("ETag"))
+	}
+
+	req.Header.Set("If-None-Match", "\"abc\"")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Matching If-None-Match returned %d, expected 304", rec.Code)
+	}
+
+	if files, err := cachedFiles(); err != nil || len(files) != 1 {
+		t.Errorf("Cache lists %d files, expected the metadata not to count as one", len(files))
+	}
+
+	req = httptest.NewRequest("GET", "/extra/os/x86_64/bar-1.0-1-x86_64.pkg.tar.xz", nil)
+	req.Header.Set("If-None-Match", "W/\"xyz\", W/\"abc\"")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Matching If-None-Match for uncached file returned %d, expected 304", rec.Code)
+	}
+	if _, err := os.Stat(path.Join(GetSettings().CacheDir, "extra%2Fx86_64%2Fbar-1.0-1-x86_64.pkg.tar.xz")); err != nil {
+		t.Error("File answered with 304 was not cached")
+	}
+	if evicted := evictFiles([]string{"extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz"}); len(evicted) != 1 || len(loadMeta(evicted[0]).ETag) > 0 {
+		t.Error("Metadata was kept after evicting the file")
+	}
+}
+
+func TestHandleRequestDBFreshness(t *testing.T) {
+	gets, requests := make(map[string]int), make(map[string]int)
+	etag := "\"1\""
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[path.Base(r.URL.Path)]++
+		if notModified(w, r, etag) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			gets[path.Base(r.URL.Path)]++
+		}
+		w.Write([]byte("\x89database " + etag))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+
+	for _, filename := range []string{"extra.db", "extra.db.sig"} {
+		req := httptest.NewRequest("GET", "/extra/os/x86_64/"+filename, nil)
+		etag = "\"1\""
+		handler(httptest.NewRecorder(), req)
+		handler(httptest.NewRecorder(), req)
+		if gets[filename] != 1 {
+			t.Errorf("Unchanged %s was downloaded %d times, expected once", filename, gets[filename])
+		}
+
+		etag = "\"2\""
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if gets[filename] != 2 || rec.Body.String() != "\x89database \"2\"" {
+			t.Errorf("Changed %s was not downloaded again", filename)
+		}
+		if requests[filename] != 3 {
+			t.Errorf("Three requests for %s took %d round trips upstream, expected one each", filename, requests[filename])
+		}
+	}
+}
+
+func TestHandleRequestDBSwitchedMirror(t *testing.T) {
+	var gets int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if notModified(w, r, `"1"`) {
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		w.Write([]byte("\x89database " + r.Host))
+	})
+	first, second := httptest.NewServer(handler), httptest.NewServer(handler)
+	defer first.Close()
+	defer second.Close()
+	secondURL := strings.Replace(second.URL, "127.0.0.1", "localhost", 1)
+	defer os.RemoveAll(setupTestCache(t, first.URL))
+
+	handleDB := func() string {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("GET", "/extra/os/x86_64/extra.db", nil), &Request{"extra", "os", "x86_64", "extra.db"})
+		return rec.Body.String()
+	}
+	handleDB()
+	updateSettings(func(s *Settings) { s.Mirrors = newMirrors([]string{secondURL}) })
+	if body := handleDB(); !strings.HasSuffix(body, strings.TrimPrefix(secondURL, "http://")) || gets != 2 {
+		t.Errorf("Database cached from another mirror was served as %q after %d downloads", body, gets)
+	}
+	if handleDB(); gets != 2 {
+		t.Error("Database of the new mirror was downloaded again")
+	}
+}
+
+func TestHandleRequestDBRedirectNodes(t *testing.T) {
+	var gets int32
+	node := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if notModified(w, r, `"1"`) {
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		w.Write([]byte("\x89database"))
+	})
+	first, second := httptest.NewServer(node), httptest.NewServer(node)
+	defer first.Close()
+	defer second.Close()
+	nodes := []string{first.URL, strings.Replace(second.URL, "127.0.0.1", "localhost", 1)}
+	var redirects int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&redirects, 1)
+		http.Redirect(w, r, nodes[n%2]+r.URL.Path, http.StatusFound)
+	}))
+	defer mirror.Close()
+	defer os.RemoveAll(setupTestCache(t, mirror.URL))
+	updateSettings(func(s *Settings) { s.MaxRedirects = 1 })
+
+	// The cache key names the configured mirror, never the node a request was redirected to.
+	name := cacheName(&Request{"extra", "os", "x86_64", "extra.db"})
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/extra.db", nil))
+		if rec.Body.String() != "\x89database" {
+			t.Errorf("Request %d was answered with %q", i, rec.Body.String())
+		}
+		if key := getCacheKey(name); key != strings.TrimPrefix(mirror.URL, "http://")+"::1" {
+			t.Errorf("Request %d cached the database with key %q", i, key)
+		}
+	}
+	if redirects != 3 || gets != 1 {
+		t.Errorf("Database was downloaded %d times over %d redirects to alternating nodes, expected once", gets, redirects)
+	}
+}
+
+func TestHandleRequestConcurrentDB(t *testing.T) {
+	var mu sync.Mutex
+	var gets int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if notModified(w, r, `"1"`) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			gets++
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.Write([]byte("\x89database"))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/extra.db", nil))
+			if rec.Body.String() != "\x89database" {
+				t.Errorf("Concurrent request received %q", rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if gets != 1 {
+		t.Errorf("Database was downloaded %d times by concurrent requests, expected once", gets)
+	}
+}
+
+func TestPrefetchSigs(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[path.Base(r.URL.Path)]++
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, ".sig") {
+			w.Write([]byte("\x89signature"))
+		} else {
+			w.Write([]byte(testPackage))
+		}
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.PrefetchSigs = true })
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz.sig", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "\x89signature" {
+		t.Error("Signature was not served")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["foo-1.0-1-x86_64.pkg.tar.xz.sig"] != 1 {
+		t.Errorf("Signature was requested %d times from upstream, expected once", hits["foo-1.0-1-x86_64.pkg.tar.xz.sig"])
+	}
+}
+
+func TestPrefetchFileAborted(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("\x89sig"))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	// An aborted download must not take down the process, which an unrecovered panic here would.
+	prefetchFile(Request{"extra", "os", "x86_64", "foo-1.0-1-x86_64.pkg.tar.xz.sig"})
+	if _, err := os.Stat(path.Join(cacheDir, "extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz.sig")); err == nil {
+		t.Error("Truncated signature was cached")
+	}
+}
+
+func TestHandleRequestContentEncoding(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("encoded"))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/extra.db", nil))
+	if rec.Header().Get("Content-Encoding") != "br" || rec.Header().Get("Content-Length") != "7" || rec.Body.String() != "encoded" {
+		t.Error("Encoded response was not relayed unchanged")
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "extra/x86_64/extra.db")); err == nil {
+		t.Error("Encoded response should not be cached")
+	}
+}
+
+func TestHandleRequestFlatLayoutDatabases(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		w.Write([]byte(testPackage + r.URL.Path))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	for _, arch := range []string{"x86_64", "aarch64", "x86_64"} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/core/os/"+arch+"/core.db", nil))
+		if !strings.HasSuffix(rec.Body.String(), "/core/os/"+arch+"/core.db") {
+			t.Errorf("Database for %s was served from that of another architecture", arch)
+		}
+	}
+	for _, filename := range []string{"core/x86_64/core.db", "core/aarch64/core.db"} {
+		if _, err := os.Stat(path.Join(cacheDir, filename)); err != nil {
+			t.Errorf("%s was not cached", filename)
+		}
+	}
+	if name := cacheName(&Request{"core", "os", "x86_64", "foo-1.0-1-x86_64.pkg.tar.xz"}); name != "core%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz" {
+		t.Errorf("Package is cached as %s in the flat layout", name)
+	}
+	for _, url := range []string{"/core/os/x86_64/foo-1.0-1-any.pkg.tar.xz", "/core/os/aarch64/foo-1.0-1-any.pkg.tar.xz", "/extra/os/x86_64/foo-1.0-1-any.pkg.tar.xz", "/core/os/aarch64/foo-1.0-1-any.pkg.tar.xz"} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", url, nil))
+		if !strings.HasSuffix(rec.Body.String(), url) {
+			t.Errorf("Package %s was served from that of another repository or architecture", url)
+		}
+	}
+}
+
+func TestHandleRequestDBFreshFor(t *testing.T) {
+	var checks, gets int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if notModified(w, r, `"core"`) {
+			atomic.AddInt32(&checks, 1)
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.DBFreshFor = time.Hour })
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/core/os/x86_64/core.db", nil))
+		if rec.Body.String() != testPackage {
+			t.Errorf("Request %d was answered with %q", i, rec.Body.String())
+		}
+	}
+	if checks != 0 || gets != 1 {
+		t.Errorf("Fresh database caused %d conditional and %d full requests upstream", checks, gets)
+	}
+
+	ValidatedAt[cacheName(&Request{"core", "os", "x86_64", "core.db"})] = time.Now().Add(-2 * time.Hour)
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/core/os/x86_64/core.db", nil))
+	if checks != 1 || gets != 1 {
+		t.Errorf("Stale database caused %d conditional and %d full requests upstream", checks, gets)
+	}
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/core/os/x86_64/core.db", nil))
+	if checks != 1 {
+		t.Error("Revalidated database was not considered fresh again")
+	}
+}
+
+func TestHandleRequestNestedLayout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage + r.URL.Path))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.CacheLayout = "nested" })
+
+	for _, repo := range []string{"core", "extra"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+repo+"/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	}
+	for _, repo := range []string{"core", "extra"} {
+		content, err := ioutil.ReadFile(path.Join(cacheDir, repo, "x86_64", "foo-1.0-1-x86_64.pkg.tar.xz"))
+		if err != nil || !strings.HasSuffix(string(content), "/"+repo+"/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz") {
+			t.Errorf("File of %s was not cached below its repo and architecture", repo)
+		}
+	}
+
+	files, err := cachedFiles()
+	if err != nil || len(files) != 2 || files[0].Path != "core/x86_64/foo-1.0-1-x86_64.pkg.tar.xz" {
+		t.Errorf("Unexpected cached files %v (%v)", files, err)
+	}
+
+	tempFile := path.Join(cacheDir, "core", "x86_64", ".bar-1.0-1-x86_64.pkg.tar.xz")
+	if err := ioutil.WriteFile(tempFile, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	removeTempFiles()
+	if _, err := os.Stat(tempFile); err == nil {
+		t.Error("Nested temp file was not removed")
+	}
+}
+
+func TestHandleRequestHead(t *testing.T) {
+	methods := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods[r.Method]++
+		w.Header().Set("ETag", "\"1\"")
+		w.Header().Set("Last-Modified", "Wed, 01 Jan 2020 00:00:00 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(testPackage)))
+		if r.Method == http.MethodGet {
+			w.Write([]byte(testPackage))
+		}
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	head := httptest.NewRequest("HEAD", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+	for _, state := range []string{"missing", "cached"} {
+		rec := httptest.NewRecorder()
+		handler(rec, head)
+		if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+			t.Errorf("HEAD of %s file returned %d with %d bytes of body", state, rec.Code, rec.Body.Len())
+		}
+		if rec.Header().Get("Content-Length") != strconv.Itoa(len(testPackage)) || rec.Header().Get("Last-Modified") != "Wed, 01 Jan 2020 00:00:00 GMT" {
+			t.Errorf("HEAD of %s file lacks headers: %v", state, rec.Header())
+		}
+		if state == "missing" {
+			if methods[http.MethodGet] != 0 || methods[http.MethodHead] != 1 {
+				t.Errorf("HEAD of missing file should only be forwarded, upstream saw %v", methods)
+			}
+			if entries, _ := ioutil.ReadDir(cacheDir); len(entries) != 0 {
+				t.Error("HEAD of missing file left files in the cache")
+			}
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+		}
+	}
+	if methods[http.MethodHead] != 1 {
+		t.Error("HEAD of cached file should not reach upstream")
+	}
+}
+
+func TestHandleRequestNotFound(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 4)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+			codes[i] = rec.Code
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusNotFound {
+			t.Errorf("Client %d got %d, expected 404", i, code)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(cacheDir); len(entries) != 0 {
+		t.Errorf("404 left %d files in the cache", len(entries))
+	}
+}
+
+func TestHandleRequestTruncatedUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n", len(testPackage), testPackage)
+		buf.Flush()
+		conn.Close()
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("Truncated response was not aborted: %v", r)
+			}
+		}()
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	}()
+	if entries, _ := ioutil.ReadDir(cacheDir); len(entries) != 0 {
+		t.Error("Truncated file was left in the cache")
+	}
+}
+
+func TestHandleRequestMaxFileSize(t *testing.T) {
+	var chunked bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chunked {
+			w.Write([]byte(testPackage[:len(testPackage)/2]))
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.MaxFileSize = int64(len(testPackage)) - 1 })
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Oversized file returned %d, expected 502", rec.Code)
+	}
+
+	chunked = true
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("Oversized chunked response was not aborted: %v", r)
+			}
+		}()
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	}()
+	if entries, _ := ioutil.ReadDir(cacheDir); len(entries) != 0 {
+		t.Error("Oversized file was left in the cache")
+	}
+}
+
+func TestHandlerGenericPathMode(t *testing.T) {
+	var requested string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.EscapedPath()
+		w.Write([]byte("wheel"))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) {
+		s.PathMode = "generic"
+		s.Mirrors = newMirrors([]string{upstream.URL + "/packages"})
+	})
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/ab/cd/foo%20bar-1.0.whl", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "wheel" || requested != "/packages/ab/cd/foo%20bar-1.0.whl" {
+		t.Errorf("Generic request returned %d after requesting %s from upstream", rec.Code, requested)
+	}
+	if _, err := os.Stat(path.Join(cacheDir, "ab%2Fcd%2Ffoo%20bar-1.0.whl")); err != nil {
+		t.Error("Generic file was not cached under its encoded path")
+	}
+
+	for _, requestURL := range []string{"/ab/../etc/passwd", "/ab/.foo", "/", "/ab//cd"} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", requestURL, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Generic request for %s returned %d, expected 400", requestURL, rec.Code)
+		}
+	}
+}
+
+func TestWithBasePath(t *testing.T) {
+	defer SetSettings(GetSettings())
+	var served string
+	h := withBasePath(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r.URL.Path
+	}))
+
+	for _, basePath := range []string{"/arch", "/arch/", "arch", "/arch//"} {
+		updateSettings(func(s *Settings) { s.BasePath = basePath })
+		for requestURL, expected := range map[string]string{
+			"/arch/extra/os/x86_64/foo.pkg.tar.xz": "/extra/os/x86_64/foo.pkg.tar.xz",
+			"/arch":                                "/",
+			"/arch/stats":                          "/stats",
+			"/archive/extra/os/x86_64/foo.pkg.tar.xz": "",
+			"/extra/os/x86_64/foo.pkg.tar.xz":         "",
+		} {
+			served = ""
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", requestURL, nil))
+			if served != expected || (expected == "" && rec.Code != http.StatusNotFound) {
+				t.Errorf("Base path %q: %s was served as %q with %d, expected %q", basePath, requestURL, served, rec.Code, expected)
+			}
+		}
+	}
+
+	updateSettings(func(s *Settings) { s.BasePath = "" })
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/foo.pkg.tar.xz", nil))
+	if served != "/extra/os/x86_64/foo.pkg.tar.xz" {
+		t.Error("URL should be unchanged without a base path")
+	}
+}
+
+func TestHandleRequestNoCache(t *testing.T) {
+	var hits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.NoCache = true })
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+			t.Error("File was not forwarded")
+		}
+	}
+	if hits != 2 {
+		t.Errorf("Upstream was requested %d times, expected twice", hits)
+	}
+	if entries, _ := ioutil.ReadDir(cacheDir); len(entries) != 0 {
+		t.Error("Files were written to the cache")
+	}
+}
+
+func TestHandleRequestFallbackCache(t *testing.T) {
+	var requests int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	fallbackDir, err := ioutil.TempDir("", "pkgproxy-fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fallbackDir)
+	ioutil.WriteFile(path.Join(fallbackDir, "extra%2Fx86_64%2Fold-1.0-1-x86_64.pkg.tar.xz"), []byte(testPackage+"old"), 0444)
+	updateSettings(func(s *Settings) { s.FallbackCache = fallbackDir })
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/old-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != testPackage+"old" || requests != 0 {
+		t.Errorf("Package in the fallback cache was not served from there, %d upstream requests", requests)
+	}
+	if entries, _ := ioutil.ReadDir(cacheDir); len(entries) != 0 {
+		t.Error("Package served from the fallback cache was copied into the cache")
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/new-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Body.String() != testPackage || requests != 1 {
+		t.Error("Package missing from the fallback cache was not downloaded")
+	}
+}
+
+// flushCounter is a ResponseRecorder counting how often the response was flushed.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushCounter) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func TestHandleRequestFlushes(t *testing.T) {
+	content := testPackage + strings.Repeat("x", 16*1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+
+	for _, noCache := range []bool{false, true} {
+		updateSettings(func(s *Settings) { s.NoCache = noCache })
+		rec := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+		handler(rec, httptest.NewRequest("GET", fmt.Sprintf("/extra/os/x86_64/foo-%t-1.0-1-x86_64.pkg.tar.xz", noCache), nil))
+		if rec.Body.String() != content || rec.flushes == 0 {
+			t.Errorf("Response was flushed %d times while streaming with -no-cache %t", rec.flushes, noCache)
+		}
+	}
+}
+
+func TestHandleRequestUnwritableCache(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	// Permissions don't stop root, a file in place of the cache directory does.
+	blocked := path.Join(cacheDir, "blocked")
+	if err := ioutil.WriteFile(blocked, nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	updateSettings(func(s *Settings) { s.CacheDir = blocked })
+
+	for _, filename := range []string{"foo-1.0-1-x86_64.pkg.tar.xz", "extra.db"} {
+		buf, restore := captureLog()
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/"+filename, nil))
+		restore()
+		if rec.Code != http.StatusOK || rec.Body.String() != testPackage {
+			t.Errorf("Request for %s with unwritable cache returned %d, expected the file", filename, rec.Code)
+		}
+		if !strings.Contains(buf.String(), "Cache is not writable, forwarding without caching") {
+			t.Errorf("Missing warning about unwritable cache for %s:\n%s", filename, buf.String())
+		}
+	}
+}
+
+func TestHandleRequestLockTimeout(t *testing.T) {
+	defer os.RemoveAll(setupTestCache(t))
+	updateSettings(func(s *Settings) { s.LockTimeout = 100 * time.Millisecond })
+	FileLocks.Lock("extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz")
+	defer FileLocks.Unlock("extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz")
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("Request waiting too long returned %d with Retry-After %q, expected 503 with 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestHandleRequestExtensions(t *testing.T) {
+	gets, checks := make(map[string]int), make(map[string]int)
+	var mu sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodHead || notModified(w, r, `"1"`) {
+			checks[path.Base(r.URL.Path)]++
+			return
+		}
+		gets[path.Base(r.URL.Path)]++
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".sig"):
+			w.Write([]byte("\x89signature"))
+		case strings.HasSuffix(r.URL.Path, ".pkg.tar.zst"):
+			w.Write([]byte("\x28\xb5\x2f\xfdpackage"))
+		default:
+			w.Write([]byte(testPackage))
+		}
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+
+	// Packages and everything belonging to a single package version never change and are cached for good, databases
+	// are cached as well but only served from the cache while upstream reports the same version.
+	for filename, revalidated := range map[string]bool{
+		"foo-1.0-1-x86_64.pkg.tar.zst":       false,
+		"foo-1.0-1-x86_64.pkg.tar.zst.sig":   false,
+		"foo-1.0-1-x86_64.pkg.tar.xz":        false,
+		"foo-1.0-1-x86_64.pkg.tar.xz.sig":    false,
+		"foo-1.0-1-x86_64.pkg.tar.zst.zsync": false,
+		"foo-1.0-1_to_1.0-2-x86_64.delta":    false,
+		"extra.db":                           true,
+		"extra.db.sig":                       true,
+		"extra.files":                        true,
+		"extra.files.sig":                    true,
+	} {
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/"+filename, nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("Request %d for %s returned %d", i+1, filename, rec.Code)
+			}
+		}
+		if _, err := os.Stat(path.Join(cacheDir, cacheName(&Request{"extra", "os", "x86_64", filename}))); err != nil {
+			t.Errorf("%s was not cached", filename)
+		}
+		if gets[filename] != 1 {
+			t.Errorf("%s was downloaded %d times, expected once", filename, gets[filename])
+		}
+		if revalidated && checks[filename] != 1 {
+			t.Errorf("%s was revalidated %d times, expected on every request after the first", filename, checks[filename])
+		} else if !revalidated && checks[filename] != 0 {
+			t.Errorf("%s was revalidated although it never changes", filename)
+		}
+	}
+}
+
+func TestHandlerMaxInflight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+	updateSettings(func(s *Settings) { s.MaxInflight = 2 })
+
+	done := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+		close(done)
+	}()
+	<-started
+	waiting := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil))
+		close(waiting)
+	}()
+	for FileLocks.Users("extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz") < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if c := Stats.Get(); c.InFlight != 2 || c.Waiting != 1 {
+		t.Errorf("Counted %d requests in flight and %d waiting, expected 2 and 1", c.InFlight, c.Waiting)
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/extra/os/x86_64/bar-1.0-1-x86_64.pkg.tar.xz", nil))
+	if rec.Code != http.StatusServiceUnavailable || len(rec.Header().Get("Retry-After")) == 0 {
+		t.Errorf("Request exceeding -max-inflight returned %d, expected 503 with Retry-After", rec.Code)
+	}
+	close(release)
+	<-done
+	<-waiting
+	if c := Stats.Get(); c.InFlight != 0 || c.Waiting != 0 {
+		t.Errorf("Counted %d requests in flight and %d waiting after all were handled", c.InFlight, c.Waiting)
+	}
+}
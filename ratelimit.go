@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// byteRate is a transfer rate in bytes per second, given like a byteSize optionally followed by /s.
+type byteRate int64
+
+func (r *byteRate) String() string {
+	return (*byteSize)(r).String()
+}
+
+func (r *byteRate) Set(value string) error {
+	value = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "/s")
+	return (*byteSize)(r).Set(value)
+}
+
+// rateLimiter is a token bucket shared by all readers it limits, holding at most one second worth of tokens.
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// UpstreamLimiter limits the bandwidth of all upstream downloads together.
+var UpstreamLimiter = &rateLimiter{}
+
+// wait takes n tokens out of the bucket, blocking until they would have been available at the given rate.
+func (l *rateLimiter) wait(n int, rate int64) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// limitedReader reads from r no faster than -upstream-rate-limit allows for all limitedReaders together.
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func newUpstreamReader(r io.Reader) io.Reader {
+	return &limitedReader{r, UpstreamLimiter}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	rate := GetSettings().RateLimit
+	if rate <= 0 {
+		return r.r.Read(p)
+	}
+	if int64(len(p)) > rate {
+		p = p[:rate]
+	}
+	n, err := r.r.Read(p)
+	r.limiter.wait(n, rate)
+	return n, err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// scrubRequest reconstructs the request a cached file was downloaded for, as far as it is known.
+func scrubRequest(filename string) Request {
+	if parts := strings.Split(filename, "/"); len(parts) == 3 {
+		return Request{parts[0], "os", parts[1], parts[2]}
+	}
+	if parts := strings.SplitN(filename, "%2F", 3); len(parts) == 3 && GetSettings().PathMode != "generic" {
+		return Request{parts[0], "os", parts[1], parts[2]}
+	}
+	meta := loadMeta(filename)
+	return Request{meta.Repo, "os", meta.Arch, filename}
+}
+
+// scrubFile checks a cached file against its recorded size, the look of its file type, its SHA256 sum listed in the
+// cached database of its repository and, if checkUpstream is set, the size reported by upstream. It returns why the
+// file is corrupt, or nil if it is not.
+func scrubFile(filename string, checkUpstream bool) error {
+	file, err := os.Open(path.Join(GetSettings().CacheDir, filename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	head := make([]byte, maxMagicSize)
+	n, _ := io.ReadFull(file, head)
+	hash.Write(head[:n])
+	rest, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	size := int64(n) + rest
+
+	req := scrubRequest(filename)
+	if recorded := loadMeta(filename).Size; recorded > 0 && size != recorded {
+		return fmt.Errorf("size of %d bytes differs from the %d bytes downloaded", size, recorded)
+	}
+	if err := checkPlausible(req.File, size, head[:n]); err != nil {
+		return err
+	}
+	if isDBFile(req.File) || len(req.Repo) == 0 {
+		return nil
+	}
+	if sum, err := expectedChecksum(&req); err == nil && hex.EncodeToString(hash.Sum(nil)) != sum {
+		return fmt.Errorf("SHA256 sum differs from %s.db", req.Repo)
+	}
+	if checkUpstream && len(req.Arch) > 0 {
+		resp, _, err := fetchUpstream(http.MethodHead, &req)
+		if err != nil {
+			return nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 && resp.ContentLength != size {
+			return fmt.Errorf("size of %d bytes differs from the %d bytes reported by upstream", size, resp.ContentLength)
+		}
+	}
+	return nil
+}
+
+// scrubCache checks all cached files, removing the corrupt ones if remove is set. It returns the corrupt files.
+func scrubCache(checkUpstream bool, remove bool) ([]string, error) {
+	files, err := cachedFiles()
+	if err != nil {
+		return nil, err
+	}
+	var corrupt []string
+	for _, fi := range files {
+		if err := scrubFile(fi.Path, checkUpstream); err != nil {
+			warnf(fi.Path, "Scrub", "Corrupt: %s", err)
+			corrupt = append(corrupt, fi.Path)
+		}
+	}
+	if remove {
+		for _, filename := range evictFiles(corrupt) {
+			logf(filename, "Scrub", "Removed")
+		}
+	}
+	logf("", "Scrub", "Checked %d files, %d corrupt", len(files), len(corrupt))
+	return corrupt, nil
+}
+
+// runScrub implements the scrub command, taking the same options as the proxy.
+func runScrub(args []string) error {
+	flags := flag.NewFlagSet("pkgproxy scrub", flag.ExitOnError)
+	remove := flags.Bool("delete", false, "Remove corrupt files from the cache")
+	checkUpstream := flags.Bool("check-upstream", false, "Compare the size of cached packages with the size reported by upstream")
+	s, err := parseSettings(flags, args)
+	if err != nil {
+		return err
+	}
+
+	s.Mirrors = newMirrors(s.UpstreamServers)
+	s.DBMirrors = newMirrors(s.DBUpstreams)
+	SetSettings(s)
+	UpstreamClient = newUpstreamClient(s.UpstreamTimeout, s.UpstreamConns, s.ProxyURL)
+	corrupt, err := scrubCache(*checkUpstream, *remove)
+	if err != nil {
+		return err
+	}
+	if len(corrupt) > 0 && !*remove {
+		return fmt.Errorf("found %d corrupt files, run again with -delete to remove them", len(corrupt))
+	}
+	return nil
+}
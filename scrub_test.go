@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestScrubCache(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	for _, filename := range []string{"good-1.0-1-x86_64.pkg.tar.xz", "truncated-1.0-1-x86_64.pkg.tar.xz", "tampered-1.0-1-x86_64.pkg.tar.xz"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/extra/os/x86_64/"+filename, nil))
+	}
+	writeTestDB(t, path.Join(cacheDir, "extra/x86_64/extra.db"), map[string]string{
+		"good-1.0-1-x86_64.pkg.tar.xz":     testPackage,
+		"tampered-1.0-1-x86_64.pkg.tar.xz": testPackage,
+	})
+	for filename, content := range map[string]string{
+		"extra%2Fx86_64%2Ftruncated-1.0-1-x86_64.pkg.tar.xz": testPackage[:8],
+		"extra%2Fx86_64%2Ftampered-1.0-1-x86_64.pkg.tar.xz":  testPackage[:len(testPackage)-1] + "X",
+		"extra%2Fx86_64%2Fgarbage-1.0-1-x86_64.pkg.tar.xz":   "<html>not found</html>",
+	} {
+		if err := ioutil.WriteFile(path.Join(cacheDir, filename), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	corrupt, err := scrubCache(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupt) != 3 {
+		t.Errorf("Found corrupt files %v, expected 3", corrupt)
+	}
+	for filename, kept := range map[string]bool{
+		"extra%2Fx86_64%2Fgood-1.0-1-x86_64.pkg.tar.xz":      true,
+		"extra/x86_64/extra.db":                              true,
+		"extra%2Fx86_64%2Ftruncated-1.0-1-x86_64.pkg.tar.xz": false,
+		"extra%2Fx86_64%2Ftampered-1.0-1-x86_64.pkg.tar.xz":  false,
+		"extra%2Fx86_64%2Fgarbage-1.0-1-x86_64.pkg.tar.xz":   false,
+	} {
+		if _, err := os.Stat(path.Join(cacheDir, filename)); (err == nil) != kept {
+			t.Errorf("%s: expected kept = %t", filename, kept)
+		}
+	}
+}
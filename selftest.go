@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// selfTestWriter is a ResponseWriter counting the body instead of sending it anywhere.
+type selfTestWriter struct {
+	header http.Header
+	code   int
+	bytes  int64
+}
+
+func (w *selfTestWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *selfTestWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *selfTestWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.bytes += int64(len(p))
+	return len(p), nil
+}
+
+// selfTestRequest passes a GET request for urlPath through the handler, reporting the outcome to out.
+func selfTestRequest(out io.Writer, urlPath string) (w *selfTestWriter, err error) {
+	r, err := http.NewRequest(http.MethodGet, urlPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.RemoteAddr = "127.0.0.1:0"
+	w = &selfTestWriter{header: make(http.Header)}
+	start := time.Now()
+	defer func() {
+		if p := recover(); p == http.ErrAbortHandler {
+			err = fmt.Errorf("response to %s was aborted", urlPath)
+		} else if p != nil {
+			panic(p)
+		}
+	}()
+	handler(w, r)
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	fmt.Fprintf(out, "GET %s: %d %s, %d bytes in %s", urlPath, w.code, http.StatusText(w.code), w.bytes, time.Since(start).Round(time.Millisecond))
+	if status := w.header.Get("X-Pkgproxy-Cache-Status"); len(status) > 0 {
+		fmt.Fprintf(out, " (%s)", status)
+	}
+	fmt.Fprintln(out)
+	if w.code != http.StatusOK {
+		return w, fmt.Errorf("%s was answered with %d", urlPath, w.code)
+	}
+	return w, nil
+}
+
+// selfTest fetches urlPath twice, checking that it can be downloaded from upstream and is then served from the cache.
+func selfTest(out io.Writer, urlPath string) error {
+	if _, err := selfTestRequest(out, urlPath); err != nil {
+		return err
+	}
+	if GetSettings().NoCache {
+		return nil
+	}
+	w, err := selfTestRequest(out, urlPath)
+	if err != nil {
+		return err
+	}
+	if status := w.header.Get("X-Pkgproxy-Cache-Status"); status != "HIT" {
+		return fmt.Errorf("%s was not served from the cache the second time but with status %s", urlPath, status)
+	}
+	return nil
+}
+
+// runSelfTest implements the selftest command, taking the same options as the proxy.
+func runSelfTest(args []string) error {
+	flags := flag.NewFlagSet("pkgproxy selftest", flag.ExitOnError)
+	urlPath := flags.String("path", "/core/os/x86_64/core.db", "Path of the file to fetch, as requested by pacman")
+	s, err := parseSettings(flags, args)
+	if err != nil {
+		return err
+	}
+
+	s.Mirrors = newMirrors(s.UpstreamServers)
+	s.DBMirrors = newMirrors(s.DBUpstreams)
+	s.DebugHeaders = true
+	SetSettings(s)
+	if err := checkCacheDir(); err != nil {
+		return err
+	}
+	UpstreamClient = newUpstreamClient(s.UpstreamTimeout, s.UpstreamConns, s.ProxyURL)
+	if err := os.MkdirAll(s.CacheDir, 0700); err != nil {
+		return err
+	}
+	if err := selfTest(os.Stdout, *urlPath); err != nil {
+		return err
+	}
+	fmt.Println("OK")
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing.db") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"core"`)
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	updateSettings(func(s *Settings) { s.DebugHeaders = true })
+
+	var out bytes.Buffer
+	if err := selfTest(&out, "/core/os/x86_64/core.db"); err != nil {
+		t.Errorf("Self test failed: %s\n%s", err, out.String())
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[0], "(MISS)") || !strings.HasSuffix(lines[1], "(HIT)") {
+		t.Errorf("Unexpected report:\n%s", out.String())
+	}
+
+	if err := selfTest(&out, "/core/os/x86_64/missing.db"); err == nil {
+		t.Error("Self test of a missing file succeeded")
+	}
+
+	os.Chmod(cacheDir, 0500)
+	defer os.Chmod(cacheDir, 0700)
+	if os.Getuid() != 0 {
+		if err := selfTest(&out, "/core/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz"); err == nil {
+			t.Error("Self test with an unwritable cache succeeded")
+		}
+	}
+}
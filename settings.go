@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Settings holds the configuration of pkgproxy. Fields tagged with the name of their flag are compared on
+// reload, those tagged with reload:"restart" can't be changed without restarting.
+type Settings struct {
+	ConfigFile       string        `setting:"config" reload:"restart"`
+	CacheDir         string        `setting:"cache" reload:"restart"`
+	KeepCache        bool          `setting:"keep-cache" reload:"restart"`
+	Repair           bool          `setting:"repair" reload:"restart"`
+	ListenAddr       string        `setting:"listen" reload:"restart"`
+	InstanceName     string        `setting:"instance-name" reload:"restart"`
+	ShutdownTimeout  time.Duration `setting:"shutdown-timeout" reload:"restart"`
+	PrewarmConns     int           `setting:"prewarm-conns" reload:"restart"`
+	LogFormat        string        `setting:"log-format" reload:"restart"`
+	LogLevel         logLevel      `setting:"log-level"`
+	TLSCert          string        `setting:"tls-cert" reload:"restart"`
+	TLSKey           string        `setting:"tls-key" reload:"restart"`
+	CacheLayout      string        `setting:"cache-layout" reload:"restart"`
+	PathMode         string        `setting:"path-mode" reload:"restart"`
+	UpstreamTimeout  time.Duration `setting:"upstream-timeout" reload:"restart"`
+	UpstreamRetries  int           `setting:"upstream-retries"`
+	UpstreamBackoff  time.Duration `setting:"upstream-retry-backoff"`
+	RetryStatuses    statusList    `setting:"upstream-retry-statuses"`
+	UpstreamConns    int           `setting:"upstream-idle-conns" reload:"restart"`
+	UpstreamParallel int           `setting:"upstream-parallel"`
+	MaxRedirects     int           `setting:"upstream-max-redirects"`
+	MaxDownloads     int           `setting:"max-concurrent-downloads" reload:"restart"`
+	MaxInflight      int           `setting:"max-inflight"`
+	UpstreamProxy    string        `setting:"upstream-proxy" reload:"restart"`
+	UpstreamServers  []string      `setting:"upstream"`
+	DBUpstreams      []string      `setting:"db-upstream"`
+	DBFreshFor       time.Duration `setting:"db-fresh-for"`
+	CacheDB          bool          `setting:"cache-db"`
+	UpstreamUser     string        `setting:"upstream-user"`
+	RateLimit        int64         `setting:"upstream-rate-limit"`
+	UpstreamPass     string        `setting:"upstream-pass"`
+	UpstreamHeaders  headerList    `setting:"upstream-header"`
+	ForwardErrorBody bool          `setting:"forward-error-body"`
+	DebugHeaders     bool          `setting:"debug-headers"`
+	MinFileSizes     sizeTable     `setting:"min-size"`
+	ServerHeader     string        `setting:"server-header"`
+	MaxCacheSize     int64         `setting:"max-cache-size"`
+	MaxFileSize      int64         `setting:"max-file-size"`
+	MaxCacheEntries  int           `setting:"max-cache-entries"`
+	HeaderRequests   bool          `setting:"header-requests"`
+	MtimeFallback    string        `setting:"mtime-fallback"`
+	AdminToken       string        `setting:"admin-token"`
+	Revalidate       bool          `setting:"revalidate"`
+	VerifyChecksums  bool          `setting:"verify-checksums"`
+	VerifyDBs        bool          `setting:"verify-dbs"`
+	PrefetchSigs     bool          `setting:"prefetch-sigs"`
+	MaxAge           time.Duration `setting:"max-age"`
+	LockTimeout      time.Duration `setting:"lock-timeout"`
+	StatsInterval    time.Duration `setting:"stats-interval"`
+	BasePath         string        `setting:"base-path"`
+	NoCacheSuffixes  suffixList    `setting:"no-cache-suffixes"`
+	NoCache          bool          `setting:"no-cache"`
+	Dedup            bool          `setting:"dedup"`
+	FallbackCache    string        `setting:"fallback-cache"`
+	Allow            cidrList      `setting:"allow"`
+	Repos            repoList      `setting:"repos"`
+	Deny             cidrList      `setting:"deny"`
+	TrustedProxies   cidrList      `setting:"trusted-proxies"`
+	ShowVersion      bool
+
+	Mirrors   []*Mirror
+	DBMirrors []*Mirror
+	ProxyURL  *url.URL
+}
+
+var currentSettings atomic.Value
+
+func init() {
+	currentSettings.Store(&Settings{})
+}
+
+// GetSettings returns the settings in effect, they are shared and must not be modified.
+func GetSettings() *Settings {
+	return currentSettings.Load().(*Settings)
+}
+
+// SetSettings replaces the settings in effect.
+func SetSettings(s *Settings) {
+	currentSettings.Store(s)
+}
+
+// defaultDBFreshFor is how long cached databases are served without asking upstream with -cache-db alone.
+const defaultDBFreshFor = 5 * time.Minute
+
+// parseSettings builds the settings from the command line arguments and the config file they name, if any.
+func parseSettings(flags *flag.FlagSet, args []string) (*Settings, error) {
+	s := &Settings{}
+	var upstreams, dbUpstreams stringList
+	var maxCacheSize, maxFileSize byteSize
+	var upstreamRateLimit byteRate
+	var logLevelName string
+	s.RetryStatuses = statusList{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	s.MinFileSizes = sizeTable{".pkg.tar.zst": 512, ".pkg.tar.xz": 512, ".pkg.tar.gz": 512, ".pkg.tar.bz2": 512, ".sig": 64}
+
+	flags.StringVar(&s.ConfigFile, "config", "", "Read settings from a TOML file, flags given on the command line take precedence")
+	flags.StringVar(&s.CacheDir, "cache", "", "Cache base path")
+	flags.StringVar(&s.ListenAddr, "listen", ":8080", "Listen on host:port, e.g. 127.0.0.1:8080 or [::1]:8080 for a single interface, or on a unix socket like unix:/run/pkgproxy.sock")
+	flags.StringVar(&s.ListenAddr, "port", ":8080", "Same as -listen")
+	flags.Var(&upstreams, "upstream", "Upstream URL, may be repeated to fail over to further mirrors (default \"https://mirrors.kernel.org/archlinux/$repo/os/$arch\")")
+	flags.DurationVar(&s.DBFreshFor, "db-fresh-for", 0, "Serve cached databases which upstream confirmed less than this long ago without asking it again, e.g. 10m")
+	flags.BoolVar(&s.CacheDB, "cache-db", false, "Cache databases like packages, serving them without asking upstream for as long as -db-fresh-for, 5m unless given")
+	flags.Var(&dbUpstreams, "db-upstream", "Upstream URL used for repository databases instead of -upstream, may be repeated to fail over to further mirrors")
+	flags.BoolVar(&s.ShowVersion, "version", false, "Show version information")
+	flags.BoolVar(&s.KeepCache, "keep-cache", false, "Keep the cache between restarts")
+	flags.BoolVar(&s.Repair, "repair", false, "Move entries of the cache which don't fit its layout to where it keeps them or remove them instead of refusing to start with -keep-cache")
+	flags.BoolVar(&s.DebugHeaders, "debug-headers", false, "Add headers revealing the cache status, upstream mirror and its response time to responses")
+	flags.Var(s.MinFileSizes, "min-size", "Smallest plausible size per file suffix, smaller files are not cached")
+	flags.BoolVar(&s.HeaderRequests, "header-requests", false, "Take repo and architecture from X-Pkgproxy-Repo and X-Pkgproxy-Arch headers if the URL lacks them")
+	flags.StringVar(&s.InstanceName, "instance-name", "", "Name of this instance, prefixed to every log line")
+	flags.Var(&maxCacheSize, "max-cache-size", "Evict least recently used packages once the cache exceeds this size, e.g. 500M or 10G")
+	flags.StringVar(&s.MtimeFallback, "mtime-fallback", "date", "Modification time of cached files lacking a valid Last-Modified, \"date\" for the upstream Date header or \"now\"")
+	flags.DurationVar(&s.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for running downloads on shutdown")
+	flags.IntVar(&s.PrewarmConns, "prewarm-conns", 0, "Number of connections to open to each upstream mirror at startup")
+	flags.StringVar(&s.ServerHeader, "server-header", "", "Value of the Server response header, omitted if empty")
+	flags.BoolVar(&s.ForwardErrorBody, "forward-error-body", false, "Relay the body of upstream error responses to the client")
+	flags.StringVar(&s.LogFormat, "log-format", "text", "Format of log lines, \"text\" or \"json\"")
+	flags.StringVar(&logLevelName, "log-level", "info", "Least important messages to log, \"debug\", \"info\", \"warn\" or \"error\"")
+	flags.StringVar(&s.TLSCert, "tls-cert", "", "Serve HTTPS using the PEM encoded certificate in this file, requires -tls-key")
+	flags.StringVar(&s.TLSKey, "tls-key", "", "Private key matching -tls-cert")
+	flags.DurationVar(&s.UpstreamTimeout, "upstream-timeout", 30*time.Second, "Time to wait for an upstream mirror to accept the connection and send its response headers")
+	flags.IntVar(&s.UpstreamConns, "upstream-idle-conns", 16, "Number of idle connections kept open to each upstream mirror")
+	flags.IntVar(&s.UpstreamParallel, "upstream-parallel", 1, "Number of connections a large file is downloaded over at once if the upstream accepts ranges")
+	flags.IntVar(&s.MaxRedirects, "upstream-max-redirects", 10, "Number of redirects followed for a single upstream request, 0 to treat redirects as errors")
+	flags.StringVar(&s.UpstreamUser, "upstream-user", "", "User name sent to upstream mirrors with HTTP basic authentication")
+	flags.StringVar(&s.UpstreamPass, "upstream-pass", "", "Password sent to upstream mirrors along with -upstream-user")
+	flags.Var(&s.UpstreamHeaders, "upstream-header", "Send this \"Name: Value\" header with every upstream request, may be repeated")
+	flags.Var(&upstreamRateLimit, "upstream-rate-limit", "Limit the bandwidth of all upstream downloads together to this many bytes per second, e.g. 5M/s")
+	flags.StringVar(&s.UpstreamProxy, "upstream-proxy", "", "Reach upstream mirrors through this HTTP, HTTPS or SOCKS5 proxy URL instead of the one named by HTTP_PROXY and HTTPS_PROXY")
+	flags.IntVar(&s.UpstreamRetries, "upstream-retries", 0, "Number of times a failing upstream mirror is retried before failing over to the next one")
+	flags.DurationVar(&s.UpstreamBackoff, "upstream-retry-backoff", time.Second, "Time to wait before retrying a failing upstream mirror, doubled for every further attempt")
+	flags.Var(&s.RetryStatuses, "upstream-retry-statuses", "Comma separated upstream statuses which are retried, other server errors fail over to the next mirror right away")
+	flags.BoolVar(&s.VerifyChecksums, "verify-checksums", false, "Verify downloaded packages against the SHA256 sums in the cached repository database, sending them without a Content-Length, so clients show no progress")
+	flags.BoolVar(&s.VerifyDBs, "verify-dbs", false, "Check that repository databases can be read completely before caching or serving them")
+	flags.BoolVar(&s.PrefetchSigs, "prefetch-sigs", false, "Download the signature of a package into the cache as soon as the package is requested")
+	flags.Var(&s.Allow, "allow", "Only allow clients from these comma separated CIDR ranges, may be repeated")
+	flags.Var(&s.Repos, "repos", "Only proxy these comma separated repositories, may be repeated")
+	flags.Var(&s.Deny, "deny", "Deny clients from these comma separated CIDR ranges unless they are allowed, may be repeated")
+	flags.Var(&s.TrustedProxies, "trusted-proxies", "Take the client address from X-Forwarded-For if the request comes from these CIDR ranges")
+	flags.StringVar(&s.FallbackCache, "fallback-cache", "", "Read-only directory laid out like the cache, packages found there are served instead of being downloaded")
+	flags.StringVar(&s.CacheLayout, "cache-layout", "flat", "Layout of the cache directory, \"flat\" or \"nested\" to store files below $repo/$arch")
+	flags.IntVar(&s.MaxCacheEntries, "max-cache-entries", 0, "Evict least recently used packages once the cache holds more files than this")
+	flags.Var(&maxFileSize, "max-file-size", "Refuse to download files larger than this from upstream, e.g. 2G, unlimited if 0")
+	flags.IntVar(&s.MaxInflight, "max-inflight", 0, "Answer with 503 and Retry-After while this many requests are already being handled, unlimited if 0")
+	flags.IntVar(&s.MaxDownloads, "max-concurrent-downloads", 0, "Number of files downloaded from upstream at the same time, further downloads wait for a free slot, unlimited if 0")
+	flags.StringVar(&s.PathMode, "path-mode", "arch", "Layout of request paths, \"arch\" for $repo/os/$arch/$file or \"generic\" to cache any path below the upstream URL")
+	flags.DurationVar(&s.LockTimeout, "lock-timeout", 0, "Answer requests waiting this long for another request of the same file with 503 and Retry-After, e.g. 30s, wait indefinitely if 0")
+	flags.DurationVar(&s.MaxAge, "max-age", 0, "Remove cached files which were not accessed for this long, e.g. 720h")
+	flags.DurationVar(&s.StatsInterval, "stats-interval", 0, "Log the number and size of cached files about this often, e.g. 1h, disabled if 0")
+	flags.StringVar(&s.BasePath, "base-path", "", "Path prefix all URLs are served below, e.g. /arch when behind a reverse proxy")
+	flags.Var(&s.NoCacheSuffixes, "no-cache-suffixes", "Files with these comma separated suffixes change upstream, they are only served from the cache while upstream reports the same version (default \".db,.db.sig,.files,.files.sig\")")
+	flags.BoolVar(&s.NoCache, "no-cache", false, "Forward all requests to upstream without reading or writing the cache, e.g. to rule out the cache when debugging")
+	flags.BoolVar(&s.Dedup, "dedup", false, "Store identical packages cached for several repositories only once, using hard links")
+	flags.BoolVar(&s.Revalidate, "revalidate", false, "Ask upstream whether cached packages were modified before serving them")
+	flags.StringVar(&s.AdminToken, "admin-token", "", "Bearer token granting access to the /admin/ endpoints and /stats?by=client, which are disabled if empty")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if len(s.ConfigFile) > 0 {
+		entries, err := loadConfig(s.ConfigFile)
+		if err == nil {
+			err = applyConfig(flags, entries)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not load config %s: %s", s.ConfigFile, err)
+		}
+	}
+
+	if len(s.CacheDir) == 0 {
+		var err error
+		s.CacheDir, err = os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.CacheDir = path.Join(s.CacheDir, "pkgproxy")
+
+	if s.PathMode != "arch" && s.PathMode != "generic" {
+		return nil, fmt.Errorf("invalid -path-mode %q, expected \"arch\" or \"generic\"", s.PathMode)
+	}
+	s.UpstreamServers = upstreams
+	if len(s.UpstreamServers) == 0 && s.PathMode == "generic" {
+		return nil, errors.New("-path-mode generic requires -upstream")
+	} else if len(s.Repos) > 0 && s.PathMode == "generic" {
+		return nil, errors.New("-repos can't be used with -path-mode generic")
+	} else if len(s.UpstreamServers) == 0 {
+		s.UpstreamServers = []string{"https://mirrors.kernel.org/archlinux/$repo/os/$arch"}
+	}
+	s.DBUpstreams = dbUpstreams
+	for _, upstream := range append(append([]string{}, s.UpstreamServers...), s.DBUpstreams...) {
+		if err := validateUpstream(upstream, s.PathMode); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.UpstreamProxy) > 0 {
+		var err error
+		if s.ProxyURL, err = parseProxyURL(s.UpstreamProxy); err != nil {
+			return nil, err
+		}
+	}
+	s.MaxCacheSize = int64(maxCacheSize)
+	s.MaxFileSize = int64(maxFileSize)
+	s.RateLimit = int64(upstreamRateLimit)
+	if len(s.NoCacheSuffixes) == 0 {
+		s.NoCacheSuffixes = suffixList{".db", ".db.sig", ".files", ".files.sig"}
+	}
+	if s.MtimeFallback != "date" && s.MtimeFallback != "now" {
+		return nil, fmt.Errorf("invalid -mtime-fallback %q, expected \"date\" or \"now\"", s.MtimeFallback)
+	}
+	if s.UpstreamTimeout <= 0 || s.UpstreamRetries < 0 || s.UpstreamConns < 0 || s.UpstreamBackoff < 0 || s.MaxRedirects < 0 || s.UpstreamParallel < 1 {
+		return nil, errors.New("-upstream-timeout and -upstream-parallel must be positive, -upstream-retries, -upstream-retry-backoff, -upstream-idle-conns and -upstream-max-redirects must not be negative")
+	}
+	if len(s.UpstreamPass) > 0 && len(s.UpstreamUser) == 0 {
+		return nil, errors.New("-upstream-pass requires -upstream-user")
+	}
+	if s.MaxDownloads < 0 || s.MaxCacheEntries < 0 || s.LockTimeout < 0 || s.MaxInflight < 0 || s.DBFreshFor < 0 {
+		return nil, errors.New("-max-concurrent-downloads, -max-cache-entries, -max-inflight, -lock-timeout and -db-fresh-for must not be negative")
+	}
+	if s.CacheDB && s.DBFreshFor == 0 {
+		s.DBFreshFor = defaultDBFreshFor
+	}
+	if strings.HasPrefix(s.ListenAddr, unixPrefix) {
+		if len(strings.TrimPrefix(s.ListenAddr, unixPrefix)) == 0 {
+			return nil, fmt.Errorf("invalid listen address %q, expected a socket path like unix:/run/pkgproxy.sock", s.ListenAddr)
+		}
+	} else if _, err := net.ResolveTCPAddr("tcp", s.ListenAddr); err != nil {
+		return nil, fmt.Errorf("invalid listen address %q, expected host:port like :8080, 127.0.0.1:8080 or [::1]:8080: %s", s.ListenAddr, err)
+	}
+	if (len(s.TLSCert) > 0) != (len(s.TLSKey) > 0) {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if s.CacheLayout != "flat" && s.CacheLayout != "nested" {
+		return nil, fmt.Errorf("invalid -cache-layout %q, expected \"flat\" or \"nested\"", s.CacheLayout)
+	}
+	logLevel, err := parseLogLevel(logLevelName)
+	if err != nil {
+		return nil, err
+	}
+	s.LogLevel = logLevel
+	if s.LogFormat != "text" && s.LogFormat != "json" {
+		return nil, fmt.Errorf("invalid -log-format %q, expected \"text\" or \"json\"", s.LogFormat)
+	}
+	return s, nil
+}
+
+// diffSettings returns the names of all settings which differ, split by whether they can be changed at runtime.
+func diffSettings(current, fresh *Settings) (changed []string, restart []string) {
+	currentValue, freshValue := reflect.ValueOf(current).Elem(), reflect.ValueOf(fresh).Elem()
+	for i := 0; i < currentValue.NumField(); i++ {
+		field := currentValue.Type().Field(i)
+		name := field.Tag.Get("setting")
+		if len(name) == 0 || reflect.DeepEqual(currentValue.Field(i).Interface(), freshValue.Field(i).Interface()) {
+			continue
+		}
+		if field.Tag.Get("reload") == "restart" {
+			restart = append(restart, name)
+		} else {
+			changed = append(changed, name)
+		}
+	}
+	return changed, restart
+}
+
+// reloadSettings parses the command line and config file again and applies the settings that can be changed
+// at runtime. Nothing is applied if a setting requiring a restart has changed.
+func reloadSettings() ([]string, error) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	fresh, err := parseSettings(flags, os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	current := GetSettings()
+	changed, restart := diffSettings(current, fresh)
+	if len(restart) > 0 {
+		return nil, fmt.Errorf("changing %v requires a restart", restart)
+	}
+	fresh.Mirrors = updateMirrors(current.Mirrors, fresh.UpstreamServers)
+	fresh.DBMirrors = updateMirrors(current.DBMirrors, fresh.DBUpstreams)
+	if !reflect.DeepEqual(current.UpstreamServers, fresh.UpstreamServers) || !reflect.DeepEqual(current.DBUpstreams, fresh.DBUpstreams) {
+		// Databases confirmed by the previous mirrors may differ from those of the new ones.
+		forgetValidations()
+	}
+	SetSettings(fresh)
+	return changed, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseSettingsValidation(t *testing.T) {
+	for _, args := range [][]string{
+		{"-tls-cert", "cert.pem"},
+		{"-tls-key", "key.pem"},
+		{"-log-format", "xml"},
+		{"-mtime-fallback", "never"},
+		{"-upstream", "https://example.org/core/os/$arch"},
+		{"-listen", "8080"},
+		{"-upstream-pass", "secret"},
+		{"-path-mode", "debian"},
+		{"-path-mode", "generic"},
+		{"-listen", "::1:8080"},
+		{"-listen", "unix:"},
+		{"-db-upstream", "https://example.org/core/os/$arch"},
+	} {
+		flags := flag.NewFlagSet("pkgproxy", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		if _, err := parseSettings(flags, append([]string{"-cache", "/tmp"}, args...)); err == nil {
+			t.Errorf("Settings %v should have been rejected", args)
+		}
+	}
+
+	flags := flag.NewFlagSet("pkgproxy", flag.ContinueOnError)
+	s, err := parseSettings(flags, []string{"-cache", "/tmp", "-tls-cert", "cert.pem", "-tls-key", "key.pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.TLSCert != "cert.pem" || s.TLSKey != "key.pem" || s.CacheDir != "/tmp/pkgproxy" {
+		t.Error("Parsed settings do not match the arguments")
+	}
+
+	for _, args := range [][]string{{"-listen", "[::1]:8080"}, {"-port", "127.0.0.1:8080"}, {"-listen", "unix:/run/pkgproxy.sock"}} {
+		flags := flag.NewFlagSet("pkgproxy", flag.ContinueOnError)
+		s, err := parseSettings(flags, append([]string{"-cache", "/tmp"}, args...))
+		if err != nil || s.ListenAddr != args[1] {
+			t.Errorf("Listen address %v was not accepted: %v", args, err)
+		}
+	}
+}
+
+func TestParseSettingsCacheDB(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		freshFor time.Duration
+	}{
+		{[]string{"-cache-db"}, defaultDBFreshFor},
+		{[]string{"-cache-db", "-db-fresh-for", "1h"}, time.Hour},
+		{[]string{}, 0},
+	} {
+		flags := flag.NewFlagSet("pkgproxy", flag.ContinueOnError)
+		s, err := parseSettings(flags, append([]string{"-cache", "/tmp"}, tc.args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.DBFreshFor != tc.freshFor {
+			t.Errorf("Settings %v keep databases fresh for %s, expected %s", tc.args, s.DBFreshFor, tc.freshFor)
+		}
+	}
+}
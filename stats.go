@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsCounters are the counters kept by cacheStats.
+type statsCounters struct {
+	Requests      int64 `json:"requests"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Downloads     int64 `json:"active_downloads"`
+	InFlight      int64 `json:"in_flight_requests"`
+	Waiting       int64 `json:"waiting_requests"`
+	HitBytes      int64 `json:"hit_bytes"`
+	UpstreamBytes int64 `json:"upstream_bytes"`
+}
+
+// cacheStats counts requests, cache hits and misses and the bytes transferred since startup along with the
+// downloads currently running.
+type cacheStats struct {
+	mu sync.Mutex
+	c  statsCounters
+}
+
+var Stats = &cacheStats{}
+
+func (c *cacheStats) Request() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.Requests++
+}
+
+// Begin counts a request entering the handler until End is called and returns the number of requests in flight.
+func (c *cacheStats) Begin() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.InFlight++
+	return c.c.InFlight
+}
+
+func (c *cacheStats) End() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.InFlight--
+}
+
+// Hit counts a cache hit which served size bytes.
+func (c *cacheStats) Hit(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.Hits++
+	c.c.HitBytes += size
+}
+
+// Miss counts a cache miss, the download it causes is running until DownloadDone is called.
+func (c *cacheStats) Miss() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.Misses++
+	c.c.Downloads++
+}
+
+// DownloadDone counts the end of a download which fetched size bytes from upstream.
+func (c *cacheStats) DownloadDone(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.c.Downloads--
+	c.c.UpstreamBytes += size
+}
+
+func (c *cacheStats) Get() statsCounters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counters := c.c
+	counters.Waiting = int64(FileLocks.Waiting())
+	return counters
+}
+
+// clientCounters are the requests and bytes served to a single client.
+type clientCounters struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// clientStats accounts the requests and bytes served to each client address since startup.
+type clientStats struct {
+	mu      sync.Mutex
+	clients map[string]*clientCounters
+}
+
+var ClientStats = &clientStats{clients: make(map[string]*clientCounters)}
+
+// Served counts a request of client which was answered with size bytes.
+func (c *clientStats) Served(client string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counters, ok := c.clients[client]
+	if !ok {
+		counters = &clientCounters{}
+		c.clients[client] = counters
+	}
+	counters.Requests++
+	counters.Bytes += size
+}
+
+func (c *clientStats) Get() map[string]clientCounters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clients := make(map[string]clientCounters, len(c.clients))
+	for client, counters := range c.clients {
+		clients[client] = *counters
+	}
+	return clients
+}
+
+// logStats logs a summary of the counters, e.g. when receiving SIGUSR1.
+func logStats() {
+	c := Stats.Get()
+	var ratio float64
+	if c.Hits+c.Misses > 0 {
+		ratio = 100 * float64(c.Hits) / float64(c.Hits+c.Misses)
+	}
+	logf("", "Stats", "%d requests, %d hits and %d misses (%.1f%% hit ratio), %d bytes fetched from upstream, %d bytes saved by serving from cache",
+		c.Requests, c.Hits, c.Misses, ratio, c.UpstreamBytes, c.HitBytes)
+
+	clients := ClientStats.Get()
+	addrs := make([]string, 0, len(clients))
+	for addr := range clients {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		logf("", "Stats", "%s: %d requests, %d bytes served", addr, clients[addr].Requests, clients[addr].Bytes)
+	}
+}
+
+// statsLogPoll is how often runStatsLog checks whether -stats-interval was enabled.
+const statsLogPoll = time.Minute
+
+// logCacheSize logs the number and total size of cached files.
+func logCacheSize() {
+	files, err := cachedFiles()
+	if err != nil {
+		errorf("", "Stats", "Could not list cache: %s", err)
+		return
+	}
+	var size int64
+	for _, fi := range files {
+		size += fi.Size()
+	}
+	logf("", "Stats", "Cache holds %d files with %d bytes", len(files), size)
+}
+
+// runStatsLog periodically logs the size of the cache while a stats interval is configured. Each interval is
+// lengthened by up to a tenth at random, so instances sharing a disk don't walk their caches at the same time.
+func runStatsLog() {
+	for {
+		interval := GetSettings().StatsInterval
+		if interval <= 0 {
+			time.Sleep(statsLogPoll)
+			continue
+		}
+		time.Sleep(interval + time.Duration(rand.Int63n(int64(interval)/10+1)))
+		logCacheSize()
+	}
+}
+
+// mirrorStatus is the track record of a mirror as reported by /stats.
+type mirrorStatus struct {
+	URL         string     `json:"url"`
+	Healthy     bool       `json:"healthy"`
+	Successes   int        `json:"successes"`
+	Failures    int        `json:"failures"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+}
+
+func (m *Mirror) status() mirrorStatus {
+	healthy := m.healthy()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := mirrorStatus{URL: redactURL(m.URL), Healthy: healthy, Successes: m.successes, Failures: m.failures}
+	if !m.lastFailure.IsZero() {
+		lastFailure := m.lastFailure
+		status.LastFailure = &lastFailure
+	}
+	return status
+}
+
+// repoStats is the share of the cache taken by a single repository.
+type repoStats struct {
+	CachedFiles int   `json:"cached_files"`
+	CacheSize   int64 `json:"cache_size"`
+}
+
+// statsByRepo adds up the cached files per repository. The repository is taken from the path in the nested layout
+// and from the metadata otherwise, files cached before their repository was recorded count as "unknown".
+func statsByRepo(files []cacheFile) map[string]*repoStats {
+	repos := make(map[string]*repoStats)
+	for _, fi := range files {
+		var repo string
+		if i := strings.Index(fi.Path, "/"); i >= 0 {
+			repo = fi.Path[:i]
+		} else {
+			repo = loadMeta(fi.Path).Repo
+		}
+		if len(repo) == 0 {
+			repo = "unknown"
+		}
+		if repos[repo] == nil {
+			repos[repo] = &repoStats{}
+		}
+		repos[repo].CachedFiles++
+		repos[repo].CacheSize += fi.Size()
+	}
+	return repos
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := GetSettings()
+	files, err := cachedFiles()
+	if err != nil {
+		errorf("", "Stats", "Could not list cache: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("by") == "repo" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Instance string                `json:"instance,omitempty"`
+			Repos    map[string]*repoStats `json:"repos"`
+		}{s.InstanceName, statsByRepo(files)})
+		return
+	}
+	if r.URL.Query().Get("by") == "client" {
+		// Client addresses are personal data, so they are only shown to those holding the admin token.
+		if !adminAuthorized(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Instance string                    `json:"instance,omitempty"`
+			Clients  map[string]clientCounters `json:"clients"`
+		}{s.InstanceName, ClientStats.Get()})
+		return
+	}
+	var size int64
+	for _, fi := range files {
+		size += fi.Size()
+	}
+	mirrors := make([]mirrorStatus, len(s.Mirrors))
+	for i, mirror := range s.Mirrors {
+		mirrors[i] = mirror.status()
+	}
+	var dbMirrors []mirrorStatus
+	for _, mirror := range s.DBMirrors {
+		dbMirrors = append(dbMirrors, mirror.status())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Instance    string `json:"instance,omitempty"`
+		CachedFiles int    `json:"cached_files"`
+		CacheSize   int64  `json:"cache_size"`
+		statsCounters
+		Mirrors   []mirrorStatus `json:"mirrors"`
+		DBMirrors []mirrorStatus `json:"db_mirrors,omitempty"`
+	}{s.InstanceName, len(files), size, Stats.Get(), mirrors, dbMirrors})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestStatsHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	cacheDir := setupTestCache(t, upstream.URL)
+	defer os.RemoveAll(cacheDir)
+	if err := ioutil.WriteFile(path.Join(cacheDir, ".bar-1.0-1-x86_64.pkg.tar.xz"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := Stats.Get()
+	req := httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+	handler(httptest.NewRecorder(), req)
+	handler(httptest.NewRecorder(), req)
+
+	rec := httptest.NewRecorder()
+	statsHandler(rec, httptest.NewRequest("GET", "/stats", nil))
+	var stats struct {
+		CachedFiles int   `json:"cached_files"`
+		CacheSize   int64 `json:"cache_size"`
+		statsCounters
+		Mirrors []mirrorStatus `json:"mirrors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.CachedFiles != 1 || stats.CacheSize != int64(len(testPackage)) {
+		t.Errorf("Reported %d files with %d bytes, expected 1 file with %d bytes", stats.CachedFiles, stats.CacheSize, len(testPackage))
+	}
+	size := int64(len(testPackage))
+	if stats.Requests != before.Requests+2 || stats.Hits != before.Hits+1 || stats.Misses != before.Misses+1 || stats.Downloads != 0 {
+		t.Errorf("Unexpected counters %+v", stats)
+	}
+	if stats.HitBytes != before.HitBytes+size || stats.UpstreamBytes != before.UpstreamBytes+size {
+		t.Errorf("Counted %d bytes from cache and %d from upstream, expected %d more each", stats.HitBytes, stats.UpstreamBytes, size)
+	}
+	if len(stats.Mirrors) != 1 || !stats.Mirrors[0].Healthy || stats.Mirrors[0].Successes != 1 {
+		t.Errorf("Unexpected mirror status %+v", stats.Mirrors)
+	}
+}
+
+func TestStatsHandlerByRepo(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+
+	for _, layout := range []string{"flat", "nested"} {
+		cacheDir := setupTestCache(t, upstream.URL)
+		updateSettings(func(s *Settings) { s.CacheLayout = layout })
+		for _, requestURL := range []string{
+			"/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz",
+			"/extra/os/x86_64/bar-1.0-1-x86_64.pkg.tar.xz",
+			"/multilib/os/x86_64/lib32-foo-1.0-1-x86_64.pkg.tar.xz",
+		} {
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", requestURL, nil))
+		}
+
+		rec := httptest.NewRecorder()
+		statsHandler(rec, httptest.NewRequest("GET", "/stats?by=repo", nil))
+		var stats struct {
+			Repos map[string]repoStats `json:"repos"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		size := int64(len(testPackage))
+		if stats.Repos["extra"] != (repoStats{2, 2 * size}) || stats.Repos["multilib"] != (repoStats{1, size}) || len(stats.Repos) != 2 {
+			t.Errorf("Unexpected stats %+v with %s layout", stats.Repos, layout)
+		}
+		os.RemoveAll(cacheDir)
+	}
+}
+
+func TestStatsHandlerByClient(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	defer os.RemoveAll(setupTestCache(t, upstream.URL))
+
+	before := ClientStats.Get()
+	for _, remoteAddr := range []string{"192.0.2.10:1234", "192.0.2.10:5678", "192.0.2.20:1234"} {
+		req := httptest.NewRequest("GET", "/extra/os/x86_64/foo-1.0-1-x86_64.pkg.tar.xz", nil)
+		req.RemoteAddr = remoteAddr
+		handler(httptest.NewRecorder(), req)
+	}
+
+	rec := httptest.NewRecorder()
+	statsHandler(rec, httptest.NewRequest("GET", "/stats?by=client", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Client stats without an admin token returned %d, expected 404", rec.Code)
+	}
+	updateSettings(func(s *Settings) { s.AdminToken = "secret" })
+	rec = httptest.NewRecorder()
+	statsHandler(rec, httptest.NewRequest("GET", "/stats?by=client", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Client stats without authorization returned %d, expected 401", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/stats?by=client", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	statsHandler(rec, req)
+	var stats struct {
+		Clients map[string]clientCounters `json:"clients"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(testPackage))
+	first, second := before["192.0.2.10"], before["192.0.2.20"]
+	if c := stats.Clients["192.0.2.10"]; c.Requests != first.Requests+2 || c.Bytes != first.Bytes+2*size {
+		t.Errorf("Unexpected counters %+v for the first client", c)
+	}
+	if c := stats.Clients["192.0.2.20"]; c.Requests != second.Requests+1 || c.Bytes != second.Bytes+size {
+		t.Errorf("Unexpected counters %+v for the second client", c)
+	}
+}
+
+func TestLogCacheSize(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+	ioutil.WriteFile(path.Join(cacheDir, "foo-1.0-1-x86_64.pkg.tar.xz"), []byte(testPackage), 0644)
+	ioutil.WriteFile(path.Join(cacheDir, ".bar-1.0-1-x86_64.pkg.tar.xz"), []byte("partial"), 0644)
+
+	buf, restore := captureLog()
+	logCacheSize()
+	restore()
+	if expected := fmt.Sprintf("Cache holds 1 files with %d bytes", len(testPackage)); !strings.Contains(buf.String(), expected) {
+		t.Errorf("Logged %q, expected %q", buf.String(), expected)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// notifyStatsSignal does nothing, there is no SIGUSR1 on this platform.
+func notifyStatsSignal(c chan<- os.Signal) {}
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyStatsSignal relays SIGUSR1, which asks for a summary of the statistics, to c.
+func notifyStatsSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
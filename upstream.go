@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// failoverCooldown is the time a failed mirror is passed over in favour of mirrors known to be good.
+const failoverCooldown = 5 * time.Minute
+
+// Mirror is an upstream server together with its recent track record.
+type Mirror struct {
+	URL string
+
+	mu          sync.Mutex
+	successes   int
+	failures    int
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+func newMirrors(servers []string) []*Mirror {
+	return updateMirrors(nil, servers)
+}
+
+// updateMirrors builds the mirror list for servers, keeping the track record of mirrors which are still in use.
+func updateMirrors(mirrors []*Mirror, servers []string) []*Mirror {
+	known := make(map[string]*Mirror)
+	for _, mirror := range mirrors {
+		known[mirror.URL] = mirror
+	}
+	updated := make([]*Mirror, len(servers))
+	for i, server := range servers {
+		if mirror, ok := known[server]; ok {
+			updated[i] = mirror
+		} else {
+			updated[i] = &Mirror{URL: server}
+		}
+	}
+	return updated
+}
+
+func (m *Mirror) recordSuccess() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.successes++
+	m.lastSuccess = time.Now()
+}
+
+func (m *Mirror) recordFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures++
+	m.lastFailure = time.Now()
+}
+
+// healthy reports whether the mirror did not fail recently or has recovered since.
+func (m *Mirror) healthy() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastFailure.IsZero() || m.lastSuccess.After(m.lastFailure) || time.Since(m.lastFailure) > failoverCooldown
+}
+
+func (m *Mirror) failedAt() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastFailure
+}
+
+// Host returns the host part of the mirror URL, or its scheme for local mirrors.
+func (m *Mirror) Host() string {
+	host := redactURL(m.URL)
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	if host == "" {
+		if i := strings.Index(m.URL, "://"); i >= 0 {
+			host = m.URL[:i]
+		}
+	}
+	return host
+}
+
+// redactURL removes the credentials from a URL, so it can be logged or shown.
+func redactURL(rawURL string) string {
+	start := strings.Index(rawURL, "://")
+	if start < 0 {
+		return rawURL
+	}
+	start += 3
+	end := strings.Index(rawURL[start:], "/")
+	if end < 0 {
+		end = len(rawURL) - start
+	}
+	if at := strings.LastIndex(rawURL[start:start+end], "@"); at >= 0 {
+		return rawURL[:start] + rawURL[start+at+1:]
+	}
+	return rawURL
+}
+
+// allMirrors returns the mirrors for packages followed by those for databases.
+func (s *Settings) allMirrors() []*Mirror {
+	return append(append([]*Mirror{}, s.Mirrors...), s.DBMirrors...)
+}
+
+// mirrorsFor returns the mirrors serving the file described by req, those given by -db-upstream for databases
+// if there are any.
+func mirrorsFor(req *Request) []*Mirror {
+	s := GetSettings()
+	if len(s.DBMirrors) > 0 && isDBFile(req.File) {
+		return s.DBMirrors
+	}
+	return s.Mirrors
+}
+
+// orderedMirrors returns the mirrors in the order they should be tried: healthy mirrors in their
+// configured order first, followed by recently failed mirrors, least recently failed first.
+func orderedMirrors(mirrors []*Mirror) []*Mirror {
+	ordered := make([]*Mirror, len(mirrors))
+	copy(ordered, mirrors)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		hi, hj := ordered[i].healthy(), ordered[j].healthy()
+		if hi != hj {
+			return hi
+		}
+		if !hi {
+			return ordered[i].failedAt().Before(ordered[j].failedAt())
+		}
+		return false
+	})
+	return ordered
+}
+
+// fetchUpstream requests the file described by req from the best known mirror, failing over to
+// the next mirror on connection errors and server side errors. Connection errors and the configured retryable
+// statuses are retried on the same mirror first, waiting twice as long before each further attempt.
+func fetchUpstream(method string, req *Request) (*http.Response, *Mirror, error) {
+	return fetchUpstreamContext(context.Background(), method, req, nil)
+}
+
+// fetchUpstreamContext is like fetchUpstream, adding header to the requests and giving up on all mirrors once ctx is done.
+func fetchUpstreamContext(ctx context.Context, method string, req *Request, header http.Header) (*http.Response, *Mirror, error) {
+	s := GetSettings()
+	mirrors := orderedMirrors(mirrorsFor(req))
+	for i, mirror := range mirrors {
+		backoff := s.UpstreamBackoff
+		for attempt := 0; ; attempt++ {
+			upstreamReq, err := http.NewRequest(method, buildUpstreamURL(mirror.URL, req), nil)
+			if err != nil {
+				return nil, mirror, err
+			}
+			for key, values := range header {
+				upstreamReq.Header[key] = values
+			}
+			if len(s.UpstreamUser) > 0 {
+				upstreamReq.SetBasicAuth(s.UpstreamUser, s.UpstreamPass)
+			}
+			resp, err := UpstreamClient.Do(upstreamReq.WithContext(ctx))
+			if err != nil && ctx.Err() != nil {
+				return nil, mirror, err
+			}
+			if err == nil && resp.StatusCode < http.StatusInternalServerError {
+				mirror.recordSuccess()
+				return resp, mirror, nil
+			}
+			mirror.recordFailure()
+			retry := attempt < s.UpstreamRetries && (err != nil || s.RetryStatuses.contains(resp.StatusCode))
+			if i == len(mirrors)-1 && !retry {
+				return resp, mirror, err
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+			if !retry {
+				break
+			}
+			warnf(req.File, "Upstream", "Retrying %s in %s after failed attempt %d", mirror.Host(), backoff, attempt+1)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, mirror, ctx.Err()
+			}
+			backoff *= 2
+		}
+	}
+	return nil, nil, errors.New("no upstream configured")
+}
+
+// statusList is a list of HTTP status codes separated by commas.
+type statusList []int
+
+func (l *statusList) String() string {
+	codes := make([]string, len(*l))
+	for i, code := range *l {
+		codes[i] = strconv.Itoa(code)
+	}
+	return strings.Join(codes, ",")
+}
+
+func (l *statusList) Set(value string) error {
+	*l = nil
+	for _, field := range strings.Split(value, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %q", field)
+		}
+		*l = append(*l, code)
+	}
+	return nil
+}
+
+func (l statusList) contains(code int) bool {
+	for _, c := range l {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadSlots limits the number of concurrent upstream downloads, it is nil if they are unlimited.
+var DownloadSlots chan struct{}
+
+// acquireDownloadSlot blocks until a download may start and returns the function releasing its slot.
+func acquireDownloadSlot(file string) func() {
+	if DownloadSlots == nil {
+		return func() {}
+	}
+	select {
+	case DownloadSlots <- struct{}{}:
+	default:
+		debugf(file, "Upstream", "Waiting for one of %d downloads to finish", cap(DownloadSlots))
+		DownloadSlots <- struct{}{}
+	}
+	return func() { <-DownloadSlots }
+}
+
+// UpstreamClient is shared by all upstream requests, so connections to mirrors are kept alive between downloads.
+var UpstreamClient = newUpstreamClient(30*time.Second, 16, nil)
+
+type headerList http.Header
+
+func (l *headerList) String() string {
+	headers := make([]string, 0, len(*l))
+	for name, values := range *l {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, ", ")
+}
+
+func (l *headerList) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return fmt.Errorf("invalid header %q, expected \"Name: Value\"", value)
+	}
+	name := strings.TrimSpace(value[:i])
+	if len(name) == 0 || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if *l == nil {
+		*l = make(headerList)
+	}
+	http.Header(*l).Add(name, strings.TrimSpace(value[i+1:]))
+	return nil
+}
+
+// headerTransport sets the User-Agent and the configured headers on all requests before passing them on.
+type headerTransport struct {
+	base http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		r.Header[name] = append([]string(nil), values...)
+	}
+	r.Header.Set("User-Agent", "pkgproxy/"+version)
+	for name, values := range GetSettings().UpstreamHeaders {
+		r.Header[name] = values
+	}
+	return t.base.RoundTrip(r)
+}
+
+// newUpstreamClient builds a client keeping up to idleConnsPerHost connections to each mirror open. The timeout
+// limits how long connecting to upstream and waiting for its response headers may take. Mirrors are reached through
+// proxyURL, or the proxy named in the environment if it is nil. Requests carry the configured upstream headers.
+func newUpstreamClient(timeout time.Duration, idleConnsPerHost int, proxyURL *url.URL) *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != nil {
+		proxy = http.ProxyURL(proxyURL)
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   idleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	transport.RegisterProtocol("archive", archiveTransport{})
+	return &http.Client{Transport: headerTransport{transport}, CheckRedirect: checkRedirect}
+}
+
+// checkRedirect follows up to the configured number of upstream redirects, e.g. to the nearest node of a mirror.
+// Responses are cached with the validators the final target returns, but validation is keyed by the configured
+// mirror, as the node it redirects to may change between requests.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if max := GetSettings().MaxRedirects; len(via) > max {
+		return fmt.Errorf("stopped after %d redirects", max)
+	}
+	debugf(path.Base(req.URL.Path), "Upstream", "Following redirect to %s", redactURL(req.URL.String()))
+	return nil
+}
+
+// upstreamModified asks upstream whether its version of a file differs from the cached one. Its ETag is compared with
+// etag, the one recorded when the file was cached, if both are known, otherwise its Last-Modified with modTime.
+func upstreamModified(req *Request, modTime time.Time, etag string) (bool, error) {
+	resp, _, err := fetchUpstream(http.MethodHead, req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("host responded with %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	if current := resp.Header.Get("ETag"); len(current) > 0 && len(etag) > 0 {
+		return strings.TrimPrefix(current, "W/") != strings.TrimPrefix(etag, "W/"), nil
+	}
+	lastmod, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return false, errors.New("host sent neither a known ETag nor a valid Last-Modified")
+	}
+	return lastmod.After(modTime), nil
+}
+
+// prewarmConnections opens n connections to each remote mirror and leaves them in the idle pool of the
+// upstream client, so the first downloads after startup don't pay for connection setup.
+func prewarmConnections(n int) {
+	var wg sync.WaitGroup
+	for _, mirror := range GetSettings().allMirrors() {
+		u, err := url.Parse(mirror.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		base := u.Scheme + "://" + u.Host + "/"
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(mirror *Mirror) {
+				defer wg.Done()
+				resp, err := UpstreamClient.Head(base)
+				if err != nil {
+					warnf("", "Upstream", "Could not prewarm connection to %s: %s", mirror.Host(), err)
+					return
+				}
+				resp.Body.Close()
+			}(mirror)
+		}
+	}
+	wg.Wait()
+}
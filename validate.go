@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxMagicSize is the number of leading bytes needed to recognise any of the fileMagics.
+const maxMagicSize = 6
+
+// fileMagics maps file suffixes to the leading bytes a file of that type starts with.
+var fileMagics = map[string][][]byte{
+	".pkg.tar.zst": {{0x28, 0xb5, 0x2f, 0xfd}},
+	".pkg.tar.xz":  {{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	".pkg.tar.gz":  {{0x1f, 0x8b}},
+	".pkg.tar.bz2": {{'B', 'Z', 'h'}},
+	".sig":         {{0x88}, {0x89}, {0xc2}},
+}
+
+// sizeTable maps file suffixes to the smallest plausible size of such a file.
+type sizeTable map[string]int64
+
+func (t sizeTable) String() string {
+	entries := make([]string, 0, len(t))
+	for suffix, size := range t {
+		entries = append(entries, fmt.Sprintf("%s=%d", suffix, size))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (t sizeTable) Set(value string) error {
+	for suffix := range t {
+		delete(t, suffix)
+	}
+	for _, entry := range strings.Split(value, ",") {
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], ".") {
+			return fmt.Errorf("invalid entry %q, expected .suffix=bytes", entry)
+		}
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid size in entry %q", entry)
+		}
+		t[parts[0]] = size
+	}
+	return nil
+}
+
+// longestSuffix returns the longest of the given suffixes filename ends with.
+func longestSuffix(filename string, suffixes []string) (string, bool) {
+	var match string
+	var found bool
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(filename, suffix) && len(suffix) >= len(match) {
+			match, found = suffix, true
+		}
+	}
+	return match, found
+}
+
+// checkPlausible rejects downloads which are too small for their type or don't start like one,
+// e.g. error pages served with a successful status code or truncated files.
+func checkPlausible(filename string, size int64, head []byte) error {
+	minFileSizes := GetSettings().MinFileSizes
+	suffixes := make([]string, 0, len(minFileSizes))
+	for suffix := range minFileSizes {
+		suffixes = append(suffixes, suffix)
+	}
+	if suffix, ok := longestSuffix(filename, suffixes); ok && size < minFileSizes[suffix] {
+		return fmt.Errorf("size of %d bytes is implausibly small for %s", size, suffix)
+	}
+
+	suffixes = suffixes[:0]
+	for suffix := range fileMagics {
+		suffixes = append(suffixes, suffix)
+	}
+	if suffix, ok := longestSuffix(filename, suffixes); ok {
+		for _, magic := range fileMagics[suffix] {
+			if bytes.HasPrefix(head, magic) {
+				return nil
+			}
+		}
+		return fmt.Errorf("content does not look like %s", suffix)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestCheckPlausible(t *testing.T) {
+	defer SetSettings(GetSettings())
+	updateSettings(func(s *Settings) { s.MinFileSizes = sizeTable{".pkg.tar.zst": 512, ".sig": 64} })
+
+	zstd := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x00}
+	if checkPlausible("foo-1.0-1-x86_64.pkg.tar.zst", 100, zstd) == nil {
+		t.Error("Too small package should be rejected")
+	}
+	if checkPlausible("foo-1.0-1-x86_64.pkg.tar.zst", 4096, []byte("<html>")) == nil {
+		t.Error("Package without magic bytes should be rejected")
+	}
+	if checkPlausible("foo-1.0-1-x86_64.pkg.tar.zst", 4096, zstd) != nil {
+		t.Error("Valid package should be accepted")
+	}
+	if checkPlausible("foo-1.0-1-x86_64.pkg.tar.zst.sig", 119, []byte{0x88, 0x75}) != nil {
+		t.Error("Small signature should be accepted")
+	}
+	if checkPlausible("extra.db", 10, []byte("junk")) != nil {
+		t.Error("Files without rules should be accepted")
+	}
+}
+
+func TestSizeTableSet(t *testing.T) {
+	table := sizeTable{".sig": 64}
+	if err := table.Set(".pkg.tar.zst=1024,.sig=32"); err != nil {
+		t.Error("Parsing size table failed")
+	} else if len(table) != 2 || table[".pkg.tar.zst"] != 1024 || table[".sig"] != 32 {
+		t.Error("Parsed size table does not match expected result")
+	}
+	if table.Set("pkg=abc") == nil {
+		t.Error("Parsing size table should have failed")
+	}
+}
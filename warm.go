@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// warmCache downloads the database of a repository and then all of its packages matching filter into the cache,
+// running at most concurrency downloads at once. A database cached already is revalidated first. Warmed packages count
+// as accessed, so eviction doesn't pick them first. It fails if any package could not be downloaded, after trying all
+// of them.
+func warmCache(db string, arch string, filter *regexp.Regexp, concurrency int) error {
+	repo := strings.TrimSuffix(path.Base(db), ".db")
+	dbReq := Request{repo, "os", arch, repo + ".db"}
+	if err := fetchFile(dbReq); err != nil {
+		return fmt.Errorf("could not download %s: %s", dbReq.File, err)
+	}
+	index, err := readDBChecksums(path.Join(GetSettings().CacheDir, cacheName(&dbReq)))
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", dbReq.File, err)
+	}
+
+	var filenames []string
+	for filename := range index.sums {
+		if filter == nil || filter.MatchString(filename) {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var done, failed int
+	slots := make(chan struct{}, concurrency)
+	for _, filename := range filenames {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(filename string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			req := Request{repo, "os", arch, filename}
+			err := prefetchFile(req)
+			if err == nil {
+				AccessTimes.Touch(cacheName(&req))
+			}
+			mu.Lock()
+			done++
+			if err != nil {
+				failed++
+			}
+			logf(filename, "Warm", "%d/%d done, %d failed", done, len(filenames), failed)
+			mu.Unlock()
+		}(filename)
+	}
+	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d packages could not be downloaded", failed, len(filenames))
+	}
+	return nil
+}
+
+// runWarm implements the warm command, taking the same options as the proxy.
+func runWarm(args []string) error {
+	flags := flag.NewFlagSet("pkgproxy warm", flag.ExitOnError)
+	db := flags.String("db", "", "Repository database to warm the cache with, e.g. extra.db")
+	arch := flags.String("arch", "x86_64", "Architecture of the packages")
+	pattern := flags.String("filter", "", "Only download packages whose file name matches this regular expression")
+	concurrency := flags.Int("concurrency", 4, "Number of packages downloaded at once")
+	s, err := parseSettings(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(*db) == 0 {
+		return errors.New("-db is required")
+	}
+	if *concurrency < 1 {
+		return errors.New("-concurrency must be at least 1")
+	}
+	var filter *regexp.Regexp
+	if len(*pattern) > 0 {
+		if filter, err = regexp.Compile(*pattern); err != nil {
+			return err
+		}
+	}
+
+	s.Mirrors = newMirrors(s.UpstreamServers)
+	s.DBMirrors = newMirrors(s.DBUpstreams)
+	SetSettings(s)
+	idleConns := s.UpstreamConns
+	if idleConns < *concurrency {
+		idleConns = *concurrency
+	}
+	UpstreamClient = newUpstreamClient(s.UpstreamTimeout, idleConns, s.ProxyURL)
+	if err := os.MkdirAll(s.CacheDir, 0700); err != nil {
+		return err
+	}
+	if err := AccessTimes.Load(accessIndexPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = warmCache(*db, *arch, filter, *concurrency)
+	if err := AccessTimes.Save(accessIndexPath()); err != nil {
+		return err
+	}
+	return err
+}
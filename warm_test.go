@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestWarmCache(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+	dbFile := path.Join(cacheDir, "upstream.db")
+	writeTestDB(t, dbFile, map[string]string{
+		"foo-1.0-1-x86_64.pkg.tar.xz": testPackage,
+		"bar-1.0-1-x86_64.pkg.tar.xz": testPackage,
+		"baz-1.0-1-x86_64.pkg.tar.xz": testPackage,
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) == "extra.db" {
+			http.ServeFile(w, r, dbFile)
+			return
+		}
+		w.Write([]byte(testPackage))
+	}))
+	defer upstream.Close()
+	updateSettings(func(s *Settings) { s.Mirrors = newMirrors([]string{upstream.URL + "/$repo/os/$arch"}) })
+
+	if err := warmCache("extra.db", "x86_64", regexp.MustCompile("^ba"), 2); err != nil {
+		t.Fatal(err)
+	}
+	for filename, cached := range map[string]bool{
+		"extra/x86_64/extra.db":                        true,
+		"extra%2Fx86_64%2Fbar-1.0-1-x86_64.pkg.tar.xz": true,
+		"extra%2Fx86_64%2Fbaz-1.0-1-x86_64.pkg.tar.xz": true,
+		"extra%2Fx86_64%2Ffoo-1.0-1-x86_64.pkg.tar.xz": false,
+	} {
+		if _, err := os.Stat(path.Join(cacheDir, filename)); (err == nil) != cached {
+			t.Errorf("%s: expected cached = %t", filename, cached)
+		}
+	}
+
+	// Packages cached already count as accessed as well.
+	AccessTimes.Remove("extra%2Fx86_64%2Fbar-1.0-1-x86_64.pkg.tar.xz")
+	if err := warmCache("extra.db", "x86_64", regexp.MustCompile("^ba"), 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{"extra%2Fx86_64%2Fbar-1.0-1-x86_64.pkg.tar.xz", "extra%2Fx86_64%2Fbaz-1.0-1-x86_64.pkg.tar.xz"} {
+		if AccessTimes.Get(filename, time.Time{}).IsZero() {
+			t.Errorf("%s: no access time was recorded", filename)
+		}
+	}
+}
+
+func TestWarmCacheStaleDBAndFailures(t *testing.T) {
+	cacheDir := setupTestCache(t)
+	defer os.RemoveAll(cacheDir)
+	writeTestDB(t, path.Join(cacheDir, "extra/x86_64/extra.db"), map[string]string{"old-1.0-1-x86_64.pkg.tar.xz": testPackage})
+	dbFile := path.Join(cacheDir, "upstream.db")
+	writeTestDB(t, dbFile, map[string]string{
+		"bar-1.0-1-x86_64.pkg.tar.xz": testPackage,
+		"baz-1.0-1-x86_64.pkg.tar.xz": testPackage,
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		case "extra.db":
+			http.ServeFile(w, r, dbFile)
+		case "baz-1.0-1-x86_64.pkg.tar.xz":
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte(testPackage))
+		default:
+			w.Write([]byte(testPackage))
+		}
+	}))
+	defer upstream.Close()
+	updateSettings(func(s *Settings) { s.Mirrors = newMirrors([]string{upstream.URL + "/$repo/os/$arch"}) })
+
+	if err := warmCache("extra.db", "x86_64", nil, 2); err == nil {
+		t.Error("Warming succeeded although a download broke off")
+	}
+	for filename, cached := range map[string]bool{
+		"extra%2Fx86_64%2Fbar-1.0-1-x86_64.pkg.tar.xz": true,
+		"extra%2Fx86_64%2Fbaz-1.0-1-x86_64.pkg.tar.xz": false,
+		"extra%2Fx86_64%2Fold-1.0-1-x86_64.pkg.tar.xz": false,
+	} {
+		if _, err := os.Stat(path.Join(cacheDir, filename)); (err == nil) != cached {
+			t.Errorf("%s: expected cached = %t", filename, cached)
+		}
+	}
+}